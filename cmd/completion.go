@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"slices"
+	"snapsync/configs"
+	"snapsync/snapshots"
+	"snapsync/structs"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// loadCompletionSnapshotsConfigs loads the snapshot configs to complete the command line with.
+func loadCompletionSnapshotsConfigs(cmd *cobra.Command) ([]*structs.SnapshotConfig, error) {
+	configsDir, err := cmd.Flags().GetString("config-dir")
+	if err != nil {
+		return nil, err
+	}
+	expandVars, err := cmd.Flags().GetBool("expand-vars")
+	if err != nil {
+		return nil, err
+	}
+	config, err := configs.LoadConfig(configsDir, expandVars)
+	if err != nil {
+		return nil, err
+	}
+	return configs.LoadSnapshotsConfigs(config.SnapshotsConfigsDir, expandVars)
+}
+
+// completeSnapshotsNames completes the names of the snapshot configs, skipping the ones already given.
+func completeSnapshotsNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	snapshotsConfigs, err := loadCompletionSnapshotsConfigs(cmd)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	names := []string{}
+	for _, snapshotConfig := range snapshotsConfigs {
+		if strings.HasPrefix(snapshotConfig.SnapshotName, toComplete) && !slices.Contains(args, snapshotConfig.SnapshotName) {
+			names = append(names, snapshotConfig.SnapshotName)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeSnapshotName completes the name of a snapshot config for the commands taking only one.
+func completeSnapshotName(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return completeSnapshotsNames(cmd, args, toComplete)
+}
+
+// completeSnapshotIds returns a completion function for the commands taking up to maxArgs snapshot
+// ids, like daily.3, daily.<timestamp>, daily.latest or daily.pre-restore.<timestamp>.
+func completeSnapshotIds(maxArgs int) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) >= maxArgs {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		snapshotsConfigs, err := loadCompletionSnapshotsConfigs(cmd)
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		ids := []string{}
+		for _, snapshotConfig := range snapshotsConfigs {
+			// the snapshots are listed only once the name is typed, there can be many of them
+			if !strings.HasPrefix(toComplete, snapshotConfig.SnapshotName+".") {
+				if strings.HasPrefix(snapshotConfig.SnapshotName, toComplete) {
+					ids = append(ids, snapshotConfig.SnapshotName+".")
+				}
+				continue
+			}
+			snapshotsInfo, err := snapshots.ListSnapshots(snapshotConfig)
+			if err == nil && len(snapshotsInfo) > 0 {
+				ids = append(ids, snapshotConfig.SnapshotName+"."+snapshots.LatestSelector)
+			}
+			preRestoreSnapshotsInfo, preRestoreErr := snapshots.ListPreRestoreSnapshots(snapshotConfig)
+			if preRestoreErr == nil {
+				snapshotsInfo = append(snapshotsInfo, preRestoreSnapshotsInfo...)
+			}
+			for _, snapshotInfo := range snapshotsInfo {
+				ids = append(ids, snapshotInfo.CompactName())
+			}
+		}
+		// a name alone is not an id, the completion goes on after the dot
+		directive := cobra.ShellCompDirectiveNoFileComp
+		if len(ids) > 0 && strings.HasSuffix(ids[0], ".") {
+			directive |= cobra.ShellCompDirectiveNoSpace
+		}
+		return ids, directive
+	}
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"snapsync/configs"
+	"snapsync/snapshots"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var diffChangeSymbols = map[string]string{
+	snapshots.DiffAdded:     "+",
+	snapshots.DiffRemoved:   "-",
+	snapshots.DiffModified:  "M",
+	snapshots.DiffUnchanged: "=",
+}
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff <name.A> <name.B>",
+	Short: "Show what changed between two snapshots",
+	Long: `Show the files added, removed and modified going from the snapshot A to the snapshot B, like
+snapsync diff daily.3 daily.0. The files still hard linked between the two snapshots are unchanged,
+the others are compared by size, modification time and mode. With --content the regular files of
+the same size are also compared by the SHA-256 checksum of their content, reading both of them.
+
+The list output prints a line for each path: + added, - removed, M modified with the reasons,
+= unchanged with --unchanged.`,
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: completeSnapshotIds(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		configsDir, err := cmd.Flags().GetString("config-dir")
+		if err != nil {
+			return errors.New("can 't get configs-dir flag")
+		}
+		expandVars, err := cmd.Flags().GetBool("expand-vars")
+		if err != nil {
+			return errors.New("can 't get expand-vars flag")
+		}
+		output, err := getOutputFormat(cmd)
+		if err != nil {
+			return err
+		}
+		content, err := cmd.Flags().GetBool("content")
+		if err != nil {
+			return errors.New("can 't get content flag")
+		}
+		unchanged, err := cmd.Flags().GetBool("unchanged")
+		if err != nil {
+			return errors.New("can 't get unchanged flag")
+		}
+		config, err := configs.LoadConfig(configsDir, expandVars)
+		if err != nil {
+			return fmt.Errorf("can't get %s: %w", configsDir, err)
+		}
+
+		from, err := getSnapshotInfoById(config.SnapshotsConfigsDir, expandVars, args[0])
+		if err != nil {
+			return err
+		}
+		to, err := getSnapshotInfoById(config.SnapshotsConfigsDir, expandVars, args[1])
+		if err != nil {
+			return err
+		}
+
+		diff, err := snapshots.DiffSnapshots(from, to, &snapshots.DiffOptions{Content: content, Unchanged: unchanged})
+		if err != nil {
+			return fmt.Errorf("can't diff %s and %s: %w", args[0], args[1], err)
+		}
+
+		switch output {
+		case outputJSON:
+			err = printJSON(diff)
+			if err != nil {
+				return fmt.Errorf("can't print the diff: %w", err)
+			}
+			return nil
+		case outputList:
+			for _, entry := range diff.Entries {
+				entryPath := entry.Path
+				if entry.IsDir {
+					entryPath += "/"
+				}
+				if len(entry.Reasons) > 0 {
+					fmt.Printf("%s %s (%s)\n", diffChangeSymbols[entry.Change], entryPath, strings.Join(entry.Reasons, ", "))
+				} else {
+					fmt.Printf("%s %s\n", diffChangeSymbols[entry.Change], entryPath)
+				}
+			}
+		}
+		fmt.Printf("%s -> %s: %d added, %d removed, %d modified, %d unchanged\n", diff.From, diff.To,
+			diff.Summary.Added, diff.Summary.Removed, diff.Summary.Modified, diff.Summary.Unchanged)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	addOutputFlag(diffCmd, "Output format", outputSummary, outputList, outputJSON)
+	diffCmd.Flags().Bool("content", false, "Compare also the SHA-256 checksums of the regular files of the same size")
+	diffCmd.Flags().Bool("unchanged", false, "List the unchanged paths too")
+}
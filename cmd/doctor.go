@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"snapsync/configs"
+	"snapsync/snapshots"
+
+	"github.com/spf13/cobra"
+)
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor [snapshot_name...]",
+	Short: "Repair the snapshots left inconsistent by interrupted runs",
+	Long: `Repair the snapshots left inconsistent by interrupted runs of the given snapshot configs, or of
+all of them if none is given. Runs interrupted while syncing are rolled back, runs interrupted while
+renaming the snapshots are rolled forward and orphaned tmp dirs are deleted.`,
+	ValidArgsFunction: completeSnapshotsNames,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		configsDir, err := cmd.Flags().GetString("config-dir")
+		if err != nil {
+			return errors.New("can 't get configs-dir flag")
+		}
+		expandVars, err := cmd.Flags().GetBool("expand-vars")
+		if err != nil {
+			return errors.New("can 't get expand-vars flag")
+		}
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return errors.New("can 't get dry-run flag")
+		}
+		config, err := configs.LoadConfig(configsDir, expandVars)
+		if err != nil {
+			return fmt.Errorf("can't get %s: %w", configsDir, err)
+		}
+		snapshotsConfigs, err := configs.LoadSnapshotsConfigs(config.SnapshotsConfigsDir, expandVars)
+		if err != nil {
+			return fmt.Errorf("can't get snapshots configs in %s: %w", config.SnapshotsConfigsDir, err)
+		}
+
+		snapshotsConfigsToRepair, err := selectSnapshotsConfigs(snapshotsConfigs, args)
+		if err != nil {
+			return err
+		}
+
+		for _, snapshotConfig := range snapshotsConfigsToRepair {
+			report, err := snapshots.RecoverSnapshots(snapshotConfig, dryRun)
+			if len(report.Actions) == 0 && err == nil {
+				fmt.Printf("%s: nothing to repair\n", snapshotConfig.SnapshotName)
+			}
+			for _, action := range report.Actions {
+				fmt.Printf("%s: %s\n", snapshotConfig.SnapshotName, action)
+			}
+			if err != nil {
+				return fmt.Errorf("can't repair snapshots: %w", err)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+	doctorCmd.Flags().Bool("dry-run", false, "Print what would be repaired without changing anything")
+}
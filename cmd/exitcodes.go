@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"snapsync/configs"
+	"snapsync/snapshots"
+
+	"github.com/spf13/cobra"
+)
+
+// The exit statuses of snapsync, from the errors returned by the commands. When an error wraps more
+// than one of them, like a restore where a sync failed and another was interrupted, the first one
+// in this order wins: interrupted, usage, config not found, snapshot not found, lock held, hook
+// failed, sync failed.
+const (
+	exitError            = 1
+	exitUsage            = 2
+	exitConfigNotFound   = 3
+	exitSnapshotNotFound = 4
+	exitLockHeld         = 5
+	exitSyncFailed       = 6
+	exitHookFailed       = 7
+	exitInterrupted      = 130
+)
+
+const exitCodesHelp = `Exit status:
+  0    success
+  1    any other error, like invalid configs or a snapshot not matching its checksums
+  2    unknown commands, invalid flags or arguments
+  3    config.yml or a snapshot config not found
+  4    snapshot not found
+  5    the snapshots dir is locked by another run
+  6    a sync failed
+  7    a pre or post snapshot command failed
+  130  interrupted by SIGINT or SIGTERM`
+
+// usageError is returned for invalid flags and arguments.
+type usageError struct {
+	err error
+}
+
+func (usageErr *usageError) Error() string {
+	return usageErr.err.Error()
+}
+
+func (usageErr *usageError) Unwrap() error {
+	return usageErr.err
+}
+
+// setUsageErrors makes the flag and argument errors of cmd and its subcommands usage errors.
+func setUsageErrors(cmd *cobra.Command) {
+	cmd.SetFlagErrorFunc(func(_ *cobra.Command, err error) error {
+		return &usageError{err: err}
+	})
+	// cobra rejects the unknown subcommands while looking for the command to run, with an error
+	// that can't be told apart, unless the root command validates its arguments itself
+	if cmd.Args == nil && cmd.HasSubCommands() && !cmd.HasParent() {
+		cmd.Args = unknownCommandArgs
+	}
+	if args := cmd.Args; args != nil {
+		cmd.Args = func(cmd *cobra.Command, positionalArgs []string) error {
+			err := args(cmd, positionalArgs)
+			if err != nil {
+				return &usageError{err: err}
+			}
+			return nil
+		}
+	}
+	// cobra checks the required flags and the flag groups after PreRunE, so they are checked here
+	// first to return usage errors. PreRun is skipped by cobra when PreRunE is set.
+	if preRunE := cmd.PreRunE; cmd.PreRun == nil {
+		cmd.PreRunE = func(cmd *cobra.Command, args []string) error {
+			for _, validate := range []func() error{
+				func() error { return validateFlagValues(cmd) },
+				cmd.ValidateRequiredFlags,
+				cmd.ValidateFlagGroups,
+			} {
+				if err := validate(); err != nil {
+					return &usageError{err: err}
+				}
+			}
+			if preRunE != nil {
+				return preRunE(cmd, args)
+			}
+			return nil
+		}
+	}
+	for _, subcommand := range cmd.Commands() {
+		setUsageErrors(subcommand)
+	}
+}
+
+// getExitCode returns the exit status of err.
+func getExitCode(err error) int {
+	var usageErr *usageError
+	var syncErr *snapshots.SyncError
+	var hookErr *snapshots.HookError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.Is(err, configs.ErrConfigNotFound):
+		return exitConfigNotFound
+	case errors.Is(err, snapshots.ErrSnapshotNotFound):
+		return exitSnapshotNotFound
+	case errors.Is(err, snapshots.ErrLockHeld):
+		return exitLockHeld
+	case errors.As(err, &hookErr):
+		return exitHookFailed
+	case errors.As(err, &syncErr):
+		return exitSyncFailed
+	default:
+		return exitError
+	}
+}
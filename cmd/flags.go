@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// flagValuesAnnotation is the annotation of the flags accepting only some values, with the values.
+const flagValuesAnnotation = "snapsync_values"
+
+// setFlagValues makes the flag flagName of cmd accept only values, that are also its completions.
+func setFlagValues(cmd *cobra.Command, flagName string, values ...string) {
+	cmd.Flags().SetAnnotation(flagName, flagValuesAnnotation, values)
+	cmd.RegisterFlagCompletionFunc(flagName, cobra.FixedCompletions(values, cobra.ShellCompDirectiveNoFileComp))
+}
+
+// validateFlagValues checks the flags of cmd set with setFlagValues.
+func validateFlagValues(cmd *cobra.Command) error {
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		values, ok := flag.Annotations[flagValuesAnnotation]
+		if !ok || err != nil || slices.Contains(values, flag.Value.String()) {
+			return
+		}
+		err = fmt.Errorf("invalid value %s for --%s, must be one of %s", flag.Value.String(), flag.Name, strings.Join(values, ", "))
+	})
+	return err
+}
+
+// unknownCommandArgs rejects the arguments of a command with subcommands as unknown subcommands, like
+// cobra does when the root command doesn't set Args.
+func unknownCommandArgs(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	message := fmt.Sprintf("unknown command %q for %q", args[0], cmd.CommandPath())
+	// the default distance of cobra, that it sets only when it suggests the commands itself
+	if cmd.SuggestionsMinimumDistance <= 0 {
+		cmd.SuggestionsMinimumDistance = 2
+	}
+	if suggestions := cmd.SuggestionsFor(args[0]); len(suggestions) > 0 {
+		message += ", did you mean " + strings.Join(suggestions, " or ") + "?"
+	}
+	return errors.New(message)
+}
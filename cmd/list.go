@@ -4,56 +4,214 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"encoding/csv"
+	"errors"
 	"fmt"
-	"log/slog"
+	"os"
 	"snapsync/configs"
 	"snapsync/snapshots"
+	"snapsync/structs"
 	"snapsync/utils"
+	"strconv"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
+const (
+	snapshotStatusLatest     = "latest"
+	snapshotStatusComplete   = "complete"
+	snapshotStatusPreRestore = "pre-restore"
+	snapshotStatusError      = "error"
+)
+
+// snapshotListEntry is a snapshot as printed by the list command.
+type snapshotListEntry struct {
+	SnapshotName string `json:"snapshot_name" yaml:"snapshot_name"`
+	Name         string `json:"name" yaml:"name"`
+	Path         string `json:"path" yaml:"path"`
+	// Number is nil for the snapshots with timestamp naming
+	Number       *int      `json:"number" yaml:"number"`
+	Created      time.Time `json:"created" yaml:"created"`
+	ApparentSize int64     `json:"apparent_size" yaml:"apparent_size"`
+	UniqueSize   int64     `json:"unique_size" yaml:"unique_size"`
+	SharedSize   int64     `json:"shared_size" yaml:"shared_size"`
+	// SetDiskUsage is the disk usage of all the snapshots of the same config
+	SetDiskUsage int64  `json:"set_disk_usage" yaml:"set_disk_usage"`
+	Status       string `json:"status" yaml:"status"`
+	Error        string `json:"error,omitempty" yaml:"error,omitempty"`
+	// Host and RunStatus come from the manifest, they are empty for the snapshots taken without one
+	Host      string                    `json:"host" yaml:"host"`
+	RunStatus string                    `json:"run_status" yaml:"run_status"`
+	Manifest  *structs.SnapshotManifest `json:"manifest,omitempty" yaml:"manifest,omitempty"`
+}
+
 // listCmd represents the list command
 var listCmd = &cobra.Command{
-	Use:   "list",
+	Use:   "list [snapshot_name...]",
 	Short: "List the snapshots",
-	Long:  `List the snapshots`,
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	Long: `List the snapshots of the given snapshot configs, or of all of them if none is given, with their
+apparent size, the size of the files unique to them, that deleting them would free, and the size of
+the files they share with the other snapshots through hard links. The walks of the snapshots are
+cached in the snapshots dir, so only the new snapshots are walked. The host and the outcome of the
+run that took each snapshot are read from its manifest, that the json and yaml outputs include.
+The safety snapshots taken before restoring are listed after the others, with status pre-restore.`,
+	ValidArgsFunction: completeSnapshotsNames,
+	RunE: func(cmd *cobra.Command, args []string) error {
 		configsDir, err := cmd.Flags().GetString("config-dir")
 		if err != nil {
-			slog.Error("can 't get configs-dir flag")
-			return
+			return errors.New("can 't get configs-dir flag")
 		}
 		expandVars, err := cmd.Flags().GetBool("expand-vars")
 		if err != nil {
-			slog.Error("can 't get expand-vars flag")
-			return
+			return errors.New("can 't get expand-vars flag")
+		}
+		output, err := getOutputFormat(cmd)
+		if err != nil {
+			return err
 		}
 		config, err := configs.LoadConfig(configsDir, expandVars)
 		if err != nil {
-			slog.Error("can't get " + configsDir + ": " + err.Error())
-			return
+			return fmt.Errorf("can't get %s: %w", configsDir, err)
+		}
+		snapshotsConfigs, err := configs.LoadSnapshotsConfigs(config.SnapshotsConfigsDir, expandVars)
+		if err != nil {
+			return fmt.Errorf("can't get snapshots configs in %s: %w", config.SnapshotsConfigsDir, err)
 		}
-		snapshotToList := args[0]
-		snapshotsInfo, err := snapshots.GetSnapshotsInfo(config.SnapshotsConfigsDir, expandVars, snapshotToList)
+		snapshotsConfigsToList, err := selectSnapshotsConfigs(snapshotsConfigs, args)
 		if err != nil {
-			slog.Error("Can't get snapshots of snapshot " + snapshotToList + ": " + err.Error())
-			return
+			return err
 		}
-		for _, snapshotInfo := range snapshotsInfo {
-			size, err := snapshotInfo.Size()
-			sizeStr := ""
+
+		entries := []*snapshotListEntry{}
+		setsSize := []*snapshots.SnapshotsSize{}
+		for _, snapshotConfig := range snapshotsConfigsToList {
+			snapshotsInfo, err := snapshots.ListSnapshots(snapshotConfig)
+			if err != nil {
+				return fmt.Errorf("can't get snapshots of snapshot %s: %w", snapshotConfig.SnapshotName, err)
+			}
+			// the safety snapshots share their files with the others, so they are in the same set
+			preRestoreSnapshotsInfo, err := snapshots.ListPreRestoreSnapshots(snapshotConfig)
 			if err != nil {
-				sizeStr = fmt.Sprintf("can't evaluate snapshot size: %s", err.Error())
-			} else {
-				sizeStr = utils.HumanReadableSize(size)
+				return fmt.Errorf("can't get pre-restore snapshots of snapshot %s: %w", snapshotConfig.SnapshotName, err)
 			}
-			fmt.Printf("%s, size: %s\n", snapshotInfo.CompactName(), sizeStr)
+			snapshotsInfo = append(snapshotsInfo, preRestoreSnapshotsInfo...)
+			setSize := snapshots.GetSnapshotsSize(snapshotsInfo, &snapshots.SizeOptions{
+				CacheDir: snapshots.GetSizeCacheDir(snapshotConfig),
+			})
+			setsSize = append(setsSize, setSize)
+			for i, size := range setSize.Snapshots {
+				entries = append(entries, getSnapshotListEntry(size, setSize, i == 0))
+			}
+		}
+
+		switch output {
+		case outputJSON:
+			err = printJSON(entries)
+		case outputYAML:
+			err = printYAML(entries)
+		case outputCSV:
+			err = printSnapshotsCSV(entries)
+		default:
+			err = printSnapshotsTable(entries, setsSize)
 		}
+		if err != nil {
+			return fmt.Errorf("can't print the snapshots: %w", err)
+		}
+		return nil
 	},
 }
 
+func getSnapshotListEntry(size *snapshots.SnapshotSize, setSize *snapshots.SnapshotsSize, latest bool) *snapshotListEntry {
+	snapshotInfo := size.Snapshot
+	entry := &snapshotListEntry{
+		SnapshotName: snapshotInfo.SnapshotName,
+		Name:         snapshotInfo.CompactName(),
+		Path:         snapshotInfo.Abspath,
+		Created:      snapshotInfo.Time,
+		Status:       snapshotStatusComplete,
+	}
+	if !snapshotInfo.Timestamped {
+		number := snapshotInfo.Number
+		entry.Number = &number
+	}
+	if snapshotInfo.PreRestore {
+		entry.Status = snapshotStatusPreRestore
+	} else if latest {
+		entry.Status = snapshotStatusLatest
+	}
+	entry.SetDiskUsage = setSize.DiskUsage
+	err := snapshotInfo.LoadManifest()
+	if err != nil {
+		entry.Status = snapshotStatusError
+		entry.Error = err.Error()
+	} else if snapshotInfo.Manifest != nil {
+		entry.Manifest = snapshotInfo.Manifest
+		entry.Host = snapshotInfo.Manifest.Host
+		entry.RunStatus = snapshotInfo.Manifest.Status
+	}
+	if size.Err != nil {
+		entry.Status = snapshotStatusError
+		entry.Error = fmt.Sprintf("can't evaluate snapshot size: %s", size.Err.Error())
+		return entry
+	}
+	entry.ApparentSize = size.Apparent
+	entry.UniqueSize = size.Unique
+	entry.SharedSize = size.Shared
+	return entry
+}
+
+func printSnapshotsTable(entries []*snapshotListEntry, setsSize []*snapshots.SnapshotsSize) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tCREATED\tSIZE\tUNIQUE\tSHARED\tHOST\tRUN\tSTATUS")
+	for _, entry := range entries {
+		status := entry.Status
+		if len(entry.Error) > 0 {
+			status += ": " + entry.Error
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.Name, entry.Created.Format(time.DateTime),
+			utils.HumanReadableSize(entry.ApparentSize), utils.HumanReadableSize(entry.UniqueSize),
+			utils.HumanReadableSize(entry.SharedSize), orDash(entry.Host), orDash(entry.RunStatus), status)
+	}
+	err := writer.Flush()
+	if err != nil {
+		return err
+	}
+	for _, setSize := range setsSize {
+		if len(setSize.Snapshots) == 0 {
+			continue
+		}
+		fmt.Printf("%s: %d snapshots using %s on disk\n", setSize.Snapshots[0].Snapshot.SnapshotName, len(setSize.Snapshots), utils.HumanReadableSize(setSize.DiskUsage))
+	}
+	return nil
+}
+
+// orDash returns value, or a dash if it's empty so that the table columns stay aligned.
+func orDash(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return value
+}
+
+func printSnapshotsCSV(entries []*snapshotListEntry) error {
+	writer := csv.NewWriter(os.Stdout)
+	writer.Write([]string{"snapshot_name", "name", "path", "number", "created", "apparent_size", "unique_size", "shared_size", "set_disk_usage", "status", "error", "host", "run_status"})
+	for _, entry := range entries {
+		number := ""
+		if entry.Number != nil {
+			number = strconv.Itoa(*entry.Number)
+		}
+		writer.Write([]string{entry.SnapshotName, entry.Name, entry.Path, number, entry.Created.Format(time.RFC3339),
+			strconv.FormatInt(entry.ApparentSize, 10), strconv.FormatInt(entry.UniqueSize, 10), strconv.FormatInt(entry.SharedSize, 10),
+			strconv.FormatInt(entry.SetDiskUsage, 10), entry.Status, entry.Error, entry.Host, entry.RunStatus})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
 func init() {
 	rootCmd.AddCommand(listCmd)
+	addOutputFlag(listCmd, "Output format", outputTable, outputJSON, outputYAML, outputCSV)
 }
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"snapsync/configs"
+	"snapsync/snapshots"
+
+	"github.com/spf13/cobra"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate <snapshot_name>",
+	Short: "Rename the snapshots from the <name>.<number> to the <name>.<timestamp> naming",
+	Long: `Rename the snapshots from the <name>.<number> to the <name>.<timestamp> naming, using the
+modification time of each snapshot as its timestamp, and create the <name>.latest symlink.
+Set "naming: timestamp" in the snapshot config before migrating.`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeSnapshotName,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		configsDir, err := cmd.Flags().GetString("config-dir")
+		if err != nil {
+			return errors.New("can 't get configs-dir flag")
+		}
+		expandVars, err := cmd.Flags().GetBool("expand-vars")
+		if err != nil {
+			return errors.New("can 't get expand-vars flag")
+		}
+		config, err := configs.LoadConfig(configsDir, expandVars)
+		if err != nil {
+			return fmt.Errorf("can't get %s: %w", configsDir, err)
+		}
+
+		snapshotToMigrate := args[0]
+		snapshotConfig, err := configs.GetSnapshotConfigByName(config.SnapshotsConfigsDir, expandVars, snapshotToMigrate)
+		if err != nil {
+			return err
+		}
+
+		err = snapshots.MigrateToTimestampNaming(snapshotConfig)
+		if err != nil {
+			return fmt.Errorf("an error occurred while migrating the snapshots: %w", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+}
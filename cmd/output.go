@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// The output formats of the commands with an --output flag. Each command supports only some of
+// them, but a format means the same for all of them: json and yaml print the same data, indented
+// the same way, while table, list and summary are for humans.
+const (
+	outputTable   = "table"
+	outputList    = "list"
+	outputSummary = "summary"
+	outputJSON    = "json"
+	outputYAML    = "yaml"
+	outputCSV     = "csv"
+)
+
+// addOutputFlag adds the --output flag to cmd, accepting only formats, the first of which is the
+// default. usage is the start of the help of the flag, that lists the formats.
+func addOutputFlag(cmd *cobra.Command, usage string, formats ...string) {
+	cmd.Flags().StringP("output", "o", formats[0], fmt.Sprintf("%s: %s", usage, joinOutputFormats(formats, " or ")))
+	setFlagValues(cmd, "output", formats...)
+}
+
+// getOutputFormat returns the value of the --output flag of cmd, that was already checked to be one
+// of the formats of cmd.
+func getOutputFormat(cmd *cobra.Command) (string, error) {
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return "", fmt.Errorf("can't get output flag: %s", err.Error())
+	}
+	return output, nil
+}
+
+// joinOutputFormats joins formats with commas, using lastSeparator before the last one.
+func joinOutputFormats(formats []string, lastSeparator string) string {
+	if len(formats) == 1 {
+		return formats[0]
+	}
+	return strings.Join(formats[:len(formats)-1], ", ") + lastSeparator + formats[len(formats)-1]
+}
+
+func printJSON(value any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func printYAML(value any) error {
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	err := encoder.Encode(value)
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"snapsync/configs"
+	"snapsync/snapshots"
+	"snapsync/structs"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune [snapshot_name...]",
+	Short: "Delete the snapshots not kept by the retention policy",
+	Long: `Delete the snapshots not kept by the retention policy of the given snapshot configs, or of all
+of them if none is given. The --keep-* flags replace the configured retention policy.
+
+The safety snapshots taken before restoring, named <name>.pre-restore.<timestamp>, are not deleted
+with the other snapshots. With --pre-restore the retention policy, or the --keep-* flags, are applied
+to them instead, like snapsync prune --pre-restore --keep-within 30d.`,
+	ValidArgsFunction: completeSnapshotsNames,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		configsDir, err := cmd.Flags().GetString("config-dir")
+		if err != nil {
+			return errors.New("can 't get configs-dir flag")
+		}
+		expandVars, err := cmd.Flags().GetBool("expand-vars")
+		if err != nil {
+			return errors.New("can 't get expand-vars flag")
+		}
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return errors.New("can 't get dry-run flag")
+		}
+		preRestore, err := cmd.Flags().GetBool("pre-restore")
+		if err != nil {
+			return errors.New("can 't get pre-restore flag")
+		}
+		overridePolicy, err := getRetentionPolicyFlags(cmd)
+		if err != nil {
+			return err
+		}
+		config, err := configs.LoadConfig(configsDir, expandVars)
+		if err != nil {
+			return fmt.Errorf("can't get %s: %w", configsDir, err)
+		}
+		snapshotsConfigs, err := configs.LoadSnapshotsConfigs(config.SnapshotsConfigsDir, expandVars)
+		if err != nil {
+			return fmt.Errorf("can't get snapshots configs in %s: %w", config.SnapshotsConfigsDir, err)
+		}
+
+		snapshotsConfigsToPrune, err := selectSnapshotsConfigs(snapshotsConfigs, args)
+		if err != nil {
+			return err
+		}
+
+		for _, snapshotConfig := range snapshotsConfigsToPrune {
+			policy := snapshots.GetRetentionPolicy(snapshotConfig)
+			if overridePolicy != nil {
+				policy = overridePolicy
+			}
+			prune := snapshots.PruneSnapshots
+			if preRestore {
+				prune = snapshots.PrunePreRestoreSnapshots
+			}
+			decisions, err := prune(snapshotConfig, policy, dryRun)
+			for _, decision := range decisions {
+				if decision.Keep {
+					fmt.Printf("keep %s: %s\n", decision.Snapshot.CompactName(), strings.Join(decision.Reasons, ", "))
+				} else if dryRun {
+					fmt.Printf("would delete %s: not kept by any rule\n", decision.Snapshot.CompactName())
+				} else if decision.Deleted {
+					fmt.Printf("delete %s: not kept by any rule\n", decision.Snapshot.CompactName())
+				} else {
+					// the prune stopped at a snapshot that couldn't be deleted
+					fmt.Printf("not deleted %s: not kept by any rule, but the prune failed\n", decision.Snapshot.CompactName())
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("can't prune snapshots: %w", err)
+			}
+		}
+		return nil
+	},
+}
+
+// getRetentionPolicyFlags returns the retention policy made of the --keep-* flags, or nil if none
+// of them is set.
+func getRetentionPolicyFlags(cmd *cobra.Command) (*structs.RetentionPolicy, error) {
+	policy := &structs.RetentionPolicy{}
+	changed := false
+	intFlags := map[string]*int{
+		"keep-last":    &policy.KeepLast,
+		"keep-hourly":  &policy.KeepHourly,
+		"keep-daily":   &policy.KeepDaily,
+		"keep-weekly":  &policy.KeepWeekly,
+		"keep-monthly": &policy.KeepMonthly,
+		"keep-yearly":  &policy.KeepYearly,
+	}
+	for flagName, value := range intFlags {
+		if !cmd.Flags().Changed(flagName) {
+			continue
+		}
+		flagValue, err := cmd.Flags().GetInt(flagName)
+		if err != nil {
+			return nil, fmt.Errorf("can't get %s flag: %s", flagName, err.Error())
+		}
+		*value = flagValue
+		changed = true
+	}
+	if cmd.Flags().Changed("keep-within") {
+		keepWithin, err := cmd.Flags().GetString("keep-within")
+		if err != nil {
+			return nil, fmt.Errorf("can't get keep-within flag: %s", err.Error())
+		}
+		policy.KeepWithin = keepWithin
+		changed = true
+	}
+	if !changed {
+		return nil, nil
+	}
+	return policy, nil
+}
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+	pruneCmd.Flags().Bool("dry-run", false, "Print what would be deleted without deleting anything")
+	pruneCmd.Flags().Bool("pre-restore", false, "Prune the safety snapshots taken before restoring instead of the snapshots")
+	pruneCmd.Flags().Int("keep-last", 0, "Keep the last n snapshots")
+	pruneCmd.Flags().Int("keep-hourly", 0, "Keep the last snapshot of the last n hours")
+	pruneCmd.Flags().Int("keep-daily", 0, "Keep the last snapshot of the last n days")
+	pruneCmd.Flags().Int("keep-weekly", 0, "Keep the last snapshot of the last n weeks")
+	pruneCmd.Flags().Int("keep-monthly", 0, "Keep the last snapshot of the last n months")
+	pruneCmd.Flags().Int("keep-yearly", 0, "Keep the last snapshot of the last n years")
+	pruneCmd.Flags().String("keep-within", "", "Keep the snapshots taken within this duration from the newest one, e.g. 7d")
+}
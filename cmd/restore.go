@@ -4,60 +4,241 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"snapsync/configs"
 	"snapsync/snapshots"
+	"snapsync/structs"
 	"snapsync/utils"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 // restoreCmd represents the restore command
 var restoreCmd = &cobra.Command{
-	Use:   "restore",
+	Use:   "restore <name.N>",
 	Short: "Restore a snapshot",
-	Long:  `Restore a snapshot`,
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	Long: `Restore a snapshot over the source dirs it was taken from, deleting what was added to them after.
+
+With --path only the given paths of the snapshot are restored, like --path home/etc/nginx. The paths
+are relative to the root of the snapshot, so they start with the dst_dir_in_snapshot of their dir,
+and can contain the * ? and [] wildcards. The other files of the source dirs are not touched.
+
+With --target the snapshot is restored into another dir instead, to inspect it side by side with
+the sources. With --target-layout snapshot, the default, each dir is restored into its
+dst_dir_in_snapshot inside the target, with --target-layout source into its src_dir_abspath. A
+target that overlaps with the source dirs overwrites them, so the safety snapshot is taken as well.
+
+Before changing anything the files to overwrite and to delete are printed, and the restore must be
+confirmed interactively or with --yes. Then, unless --no-pre-restore-snapshot is given, the current
+state of the sources is saved in the safety snapshot <name>.pre-restore.<timestamp>, so that a wrong
+restore can be undone restoring it. The safety snapshots are listed by snapsync list, and they are
+not deleted by the retention policy, but only by snapsync prune --pre-restore.
+
+When a dir can't be restored, the restore goes on with the other dirs and the failed ones are
+listed at the end, with --fail-fast it stops at the first failure instead. The exit status is not
+zero if anything failed.
+
+With --dry-run nothing is changed, and every file that the restore would create, overwrite or
+delete is printed, or the whole plan as JSON with --output json.`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeSnapshotIds(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
 		configsDir, err := cmd.Flags().GetString("config-dir")
 		if err != nil {
-			slog.Error("can 't get configs-dir flag")
-			return
+			return errors.New("can 't get configs-dir flag")
 		}
 		expandVars, err := cmd.Flags().GetBool("expand-vars")
 		if err != nil {
-			slog.Error("can 't get expand-vars flag")
-			return
+			return errors.New("can 't get expand-vars flag")
+		}
+		paths, err := cmd.Flags().GetStringArray("path")
+		if err != nil {
+			return errors.New("can 't get path flag")
+		}
+		target, err := cmd.Flags().GetString("target")
+		if err != nil {
+			return errors.New("can 't get target flag")
+		}
+		if len(target) > 0 {
+			target, err = filepath.Abs(target)
+			if err != nil {
+				return fmt.Errorf("can't get the absolute path of the target: %w", err)
+			}
+		}
+		targetLayout, err := cmd.Flags().GetString("target-layout")
+		if err != nil {
+			return errors.New("can 't get target-layout flag")
+		}
+		yes, err := cmd.Flags().GetBool("yes")
+		if err != nil {
+			return errors.New("can 't get yes flag")
+		}
+		noPreRestoreSnapshot, err := cmd.Flags().GetBool("no-pre-restore-snapshot")
+		if err != nil {
+			return errors.New("can 't get no-pre-restore-snapshot flag")
+		}
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return errors.New("can 't get dry-run flag")
+		}
+		failFast, err := cmd.Flags().GetBool("fail-fast")
+		if err != nil {
+			return errors.New("can 't get fail-fast flag")
+		}
+		continueOnError, err := cmd.Flags().GetBool("continue-on-error")
+		if err != nil {
+			return errors.New("can 't get continue-on-error flag")
+		}
+		// the flags are mutually exclusive, --continue-on-error only spells out the default
+		failFast = failFast && !continueOnError
+		output, err := getOutputFormat(cmd)
+		if err != nil {
+			return err
 		}
 		config, err := configs.LoadConfig(configsDir, expandVars)
 		if err != nil {
-			slog.Error("can't get " + configsDir + ": " + err.Error())
-			return
+			return fmt.Errorf("can't get %s: %w", configsDir, err)
 		}
 
 		snapshotToRestore := args[0]
 
-		snapshotName, number, err := utils.GetInfoFromSnapshotBasePath(snapshotToRestore)
+		snapshotName, selector, err := utils.SplitSnapshotId(snapshotToRestore)
 		if err != nil {
-			slog.Error(fmt.Sprintf("can't get snapshot info: %s", err.Error()))
-			return
+			return fmt.Errorf("can't get snapshot info: %w", err)
 		}
 
 		snapshotConfig, err := configs.GetSnapshotConfigByName(config.SnapshotsConfigsDir, expandVars, snapshotName)
 		if err != nil {
-			slog.Error("An error occurred: " + err.Error())
-			return
+			return err
 		}
 
-		err = snapshots.RestoreSnapshot(config, number, snapshotConfig)
+		snapshotInfo, err := snapshots.GetSnapshotInfo(snapshotConfig, selector)
 		if err != nil {
-			slog.Error("an error occurred while restoring the snapshot: " + err.Error())
-			return
+			return fmt.Errorf("can't get snapshot info: %w", err)
 		}
+
+		err = snapshotInfo.LoadManifest()
+		if err != nil {
+			slog.Warn(err.Error())
+		}
+		if manifest := snapshotInfo.Manifest; manifest != nil {
+			slog.Info(fmt.Sprintf("restoring %s taken at %s on %s by snapsync %s", snapshotInfo.CompactName(), manifest.SnapshotTime.Format(time.RFC3339), manifest.Host, manifest.SnapsyncVersion))
+			if manifest.Status != structs.ManifestStatusSuccess {
+				message := fmt.Sprintf("the run that took %s ended with status %s", snapshotInfo.CompactName(), manifest.Status)
+				if len(manifest.Error) > 0 {
+					message += ": " + manifest.Error
+				}
+				slog.Warn(message)
+			}
+		} else {
+			slog.Info(fmt.Sprintf("restoring %s taken at %s", snapshotInfo.CompactName(), snapshotInfo.Time.Format(time.RFC3339)))
+		}
+
+		restoreOptions := &snapshots.RestoreOptions{
+			Paths:              paths,
+			Target:             target,
+			TargetLayout:       targetLayout,
+			PreRestoreSnapshot: !noPreRestoreSnapshot,
+			FailFast:           failFast,
+			Confirm: func(plan *snapshots.RestorePlan) bool {
+				printRestorePlan(plan, restorePlanPreviewLength)
+				return yes || askConfirmation(fmt.Sprintf("restore %s?", plan.Snapshot))
+			},
+		}
+		if dryRun {
+			plan, err := snapshots.PlanRestore(snapshotInfo, snapshotConfig, restoreOptions)
+			if err != nil {
+				return fmt.Errorf("can't plan the restore: %w", err)
+			}
+			if output == outputJSON {
+				err = printJSON(plan)
+				if err != nil {
+					return fmt.Errorf("can't print the plan: %w", err)
+				}
+				return nil
+			}
+			printRestorePlan(plan, -1)
+			return nil
+		}
+
+		// on SIGINT and SIGTERM the sync is stopped instead of leaving it running in the background
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = snapshots.RestoreSnapshot(ctx, config, snapshotInfo, snapshotConfig, restoreOptions)
+		if err != nil {
+			return fmt.Errorf("an error occurred while restoring the snapshot: %w", err)
+		}
+		return nil
 	},
 }
 
+const (
+	// restorePlanPreviewLength is the number of files of each kind printed for each dir before asking
+	// to confirm the restore
+	restorePlanPreviewLength = 10
+)
+
+// printRestorePlan prints, for each dir, the number of files the restore creates, overwrites and
+// deletes, and up to limit files of each kind, or all of them if limit is negative.
+func printRestorePlan(plan *snapshots.RestorePlan, limit int) {
+	for _, dirPlan := range plan.Dirs {
+		fmt.Printf("%s -> %s: %d to create, %d to overwrite, %d to delete\n", dirPlan.SnapshotPath, dirPlan.TargetPath,
+			len(dirPlan.Create), len(dirPlan.Update), len(dirPlan.Delete))
+		printRestorePlanPaths("create", dirPlan.Create, limit)
+		printRestorePlanPaths("overwrite", dirPlan.Update, limit)
+		printRestorePlanPaths("delete", dirPlan.Delete, limit)
+	}
+	fmt.Printf("%s: %d to create, %d to overwrite, %d to delete\n", plan.Snapshot, plan.Summary.Create, plan.Summary.Update, plan.Summary.Delete)
+}
+
+func printRestorePlanPaths(action string, paths []string, limit int) {
+	for i, changedPath := range paths {
+		if i == limit {
+			fmt.Printf("  ... and %d more to %s\n", len(paths)-limit, action)
+			return
+		}
+		fmt.Printf("  %s %s\n", action, changedPath)
+	}
+}
+
+// askConfirmation asks question on the terminal, and returns true if the answer is yes. Without a
+// terminal to ask it returns false.
+func askConfirmation(question string) bool {
+	stdinInfo, err := os.Stdin.Stat()
+	if err != nil || stdinInfo.Mode()&os.ModeCharDevice == 0 {
+		fmt.Fprintln(os.Stderr, "not running in a terminal, add --yes to confirm")
+		return false
+	}
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		fmt.Println()
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
 func init() {
 	rootCmd.AddCommand(restoreCmd)
+	restoreCmd.Flags().StringArray("path", []string{}, "Restore only this path of the snapshot, can be repeated")
+	restoreCmd.Flags().String("target", "", "Restore into this dir instead of the source dirs")
+	restoreCmd.Flags().String("target-layout", snapshots.RestoreLayoutSnapshot, "Layout of the dirs inside the target: snapshot or source")
+	setFlagValues(restoreCmd, "target-layout", snapshots.RestoreLayoutSnapshot, snapshots.RestoreLayoutSource)
+	restoreCmd.Flags().BoolP("yes", "y", false, "Restore without asking to confirm")
+	restoreCmd.Flags().Bool("no-pre-restore-snapshot", false, "Don't save the current state of the sources before restoring")
+	restoreCmd.Flags().Bool("continue-on-error", false, "Go on restoring the other dirs when a dir fails, the default")
+	restoreCmd.Flags().Bool("fail-fast", false, "Stop at the first dir that fails")
+	restoreCmd.MarkFlagsMutuallyExclusive("continue-on-error", "fail-fast")
+	restoreCmd.Flags().Bool("dry-run", false, "Print what the restore would change without changing anything")
+	addOutputFlag(restoreCmd, "Output format of --dry-run", outputList, outputJSON)
 }
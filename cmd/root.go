@@ -4,43 +4,76 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
 	"snapsync/configs"
 	"snapsync/snapshots"
 	"snapsync/structs"
+	"snapsync/utils"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
 	"github.com/spf13/cobra"
 )
 
+const (
+	defaultShutdownGracePeriod          = 30 * time.Second
+	defaultSnapshotsConfigsPollInterval = 10 * time.Second
+)
+
 var rootCmd = &cobra.Command{
 	Use:   "snapsync",
 	Short: "Snapsync is tool that performs snapshots of directories using rsync and hard links to use less space.",
 	Long:  `Snapsync is tool that performs snapshots of directories using rsync and hard links to use less space.`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		configsDir, err := cmd.Flags().GetString("config-dir")
 		if err != nil {
-			slog.Error("can't get config-dir flag")
-			return
+			return errors.New("can't get config-dir flag")
 		}
 		expandVars, err := cmd.Flags().GetBool("expand-vars")
 		if err != nil {
-			slog.Error("can't get expand-vars flag")
-			return
+			return errors.New("can't get expand-vars flag")
+		}
+		runOnce, err := cmd.Flags().GetStringArray("run-once")
+		if err != nil {
+			return fmt.Errorf("can't get run-once flag: %w", err)
+		}
+
+		// the daemon reloads the snapshot configs on SIGHUP. It is caught before loading the configs and
+		// recovering the snapshots, so that a SIGHUP sent while starting up neither kills the daemon nor
+		// is lost: it is handled once the scheduler runs
+		hangups := make(chan os.Signal, 1)
+		if len(runOnce) == 0 {
+			signal.Notify(hangups, syscall.SIGHUP)
+			defer signal.Stop(hangups)
 		}
+
 		config, err := configs.LoadConfig(configsDir, expandVars)
 		if err != nil {
-			slog.Error("can't get " + configsDir + ": " + err.Error())
-			return
+			return fmt.Errorf("can't get %s: %w", configsDir, err)
+		}
+		// refuse to start with invalid configs, reporting all their problems at once
+		problems := configs.ValidateConfigs(configsDir, expandVars)
+		if len(problems) > 0 {
+			for _, problem := range problems {
+				slog.Error(problem.String())
+			}
+			return fmt.Errorf("%d problems found in the configs", len(problems))
 		}
 
-		runOnce, err := cmd.Flags().GetStringArray("run-once")
+		gracePeriod, err := getShutdownGracePeriod(config)
+		if err != nil {
+			return err
+		}
+		pollInterval, err := getSnapshotsConfigsPollInterval(config)
 		if err != nil {
-			slog.Error(fmt.Sprintf("can't get run-once flag: %s", err.Error()))
-			return
+			return err
 		}
 
 		snapshotsConfigs, err := configs.LoadSnapshotsConfigs(config.SnapshotsConfigsDir, expandVars)
@@ -48,73 +81,223 @@ var rootCmd = &cobra.Command{
 			slog.Error("Can't get snapshots configs in " + configsDir + ": " + err.Error())
 		}
 
-		snapshotTask := func(snapshotConfig *structs.SnapshotConfig) {
-			snapshotErr := snapshots.ExecuteSnapshot(config, snapshotConfig)
-			if snapshotErr != nil {
+		// SIGINT and SIGTERM request the shutdown. The snapshots have their own context, canceled only
+		// when they don't complete within the grace period, so that they are not interrupted right away
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		snapshotsCtx, cancelSnapshots := context.WithCancel(context.Background())
+		defer cancelSnapshots()
+		var runningSnapshots sync.WaitGroup
+
+		executeSnapshot := func(snapshotConfig *structs.SnapshotConfig) error {
+			runningSnapshots.Add(1)
+			defer runningSnapshots.Done()
+			snapshotErr := snapshots.ExecuteSnapshot(snapshotsCtx, config, snapshotConfig)
+			if errors.Is(snapshotErr, context.Canceled) {
+				slog.Warn(fmt.Sprintf("[%s] snapshot interrupted", snapshotConfig.SnapshotName))
+			} else if errors.Is(snapshotErr, snapshots.ErrLockHeld) {
+				slog.Warn(fmt.Sprintf("[%s] snapshot skipped: %s", snapshotConfig.SnapshotName, snapshotErr.Error()))
+			} else if snapshotErr != nil {
 				slog.Error(fmt.Sprintf("[%s] can't execute snapshot: %s", snapshotConfig.SnapshotName, snapshotErr.Error()))
 			}
+			return snapshotErr
+		}
+		snapshotTask := func(snapshotConfig *structs.SnapshotConfig) {
+			executeSnapshot(snapshotConfig)
 		}
 
 		if len(runOnce) > 0 {
+			// there is nobody to wait for when running once, so the snapshot is interrupted right away
+			stopInterrupting := context.AfterFunc(ctx, cancelSnapshots)
+			defer stopInterrupting()
+			runOnceErr := &runOnceError{total: len(runOnce)}
 			for _, snapshotToRun := range runOnce {
-				var sc *structs.SnapshotConfig
-				for _, snapshotConfig := range snapshotsConfigs {
-					if snapshotToRun == snapshotConfig.SnapshotName {
-						sc = snapshotConfig
-						break
-					}
+				if ctx.Err() != nil {
+					break
 				}
-				if sc != nil {
-					snapshotTask(sc)
-				} else {
-					slog.Error(fmt.Sprintf("there is not snapshot named %s", runOnce))
+				sc, err := configs.FindSnapshotConfig(snapshotsConfigs, snapshotToRun)
+				if err != nil {
+					slog.Error(err.Error())
+					runOnceErr.errs = append(runOnceErr.errs, err)
+				} else if err = executeSnapshot(sc); err != nil {
+					runOnceErr.errs = append(runOnceErr.errs, err)
 				}
 			}
-			return
+			if ctx.Err() != nil {
+				return fmt.Errorf("interrupted: %w", ctx.Err())
+			}
+			if len(runOnceErr.errs) > 0 {
+				return runOnceErr
+			}
+			return nil
 		}
 
-		snapshotsConfigsToSchedule := []*structs.SnapshotConfig{}
+		// repair the snapshots left inconsistent by a run that was killed. The snapshots being taken by
+		// a --run-once are skipped, they are repaired before each run anyway
 		for _, snapshotConfig := range snapshotsConfigs {
-			if len(snapshotConfig.Cron) == 0 {
-				continue
+			_, err = snapshots.RecoverSnapshots(snapshotConfig, false)
+			if errors.Is(err, snapshots.ErrLockHeld) {
+				slog.Warn(fmt.Sprintf("[%s] not recovering snapshots: %s", snapshotConfig.SnapshotName, err.Error()))
+			} else if err != nil {
+				slog.Error(fmt.Sprintf("[%s] can't recover snapshots: %s", snapshotConfig.SnapshotName, err.Error()))
 			}
-			snapshotsConfigsToSchedule = append(snapshotsConfigsToSchedule, snapshotConfig)
-		}
-		scheduler, err := gocron.NewScheduler()
-		for _, snapshotConfig := range snapshotsConfigsToSchedule {
-			_, err := scheduler.NewJob(
-				gocron.CronJob(snapshotConfig.Cron, false),
-				gocron.NewTask(
-					snapshotTask,
-					snapshotConfig,
-				),
-			)
+		}
+
+		scheduler, err := gocron.NewScheduler(gocron.WithStopTimeout(gracePeriod))
+		if err != nil {
+			return fmt.Errorf("can't create scheduler: %w", err)
+		}
+		schedule := newSnapshotsSchedule(scheduler, snapshotTask)
+		err = schedule.apply(snapshotsConfigs)
+		if err != nil {
+			return err
+		}
+		scheduler.Start()
+
+		// the snapshot configs are reloaded on SIGHUP and when they change
+		changes := make(chan struct{}, 1)
+		if pollInterval > 0 {
+			stopWatching := make(chan struct{})
+			defer close(stopWatching)
+			go watchSnapshotsConfigsDir(config.SnapshotsConfigsDir, pollInterval, changes, stopWatching)
+		}
+		reload := func() {
+			newSnapshotsConfigs, err := loadValidSnapshotsConfigs(config.SnapshotsConfigsDir, expandVars)
 			if err != nil {
-				slog.Error("Can't add cron job for snapshot " + snapshotConfig.SnapshotName + ". Cron string is " + snapshotConfig.Cron)
+				slog.Error("not reloading the snapshot configs, keeping the current schedule: " + err.Error())
 				return
 			}
-			slog.Info(fmt.Sprintf("[%s] scheduled with cron %s", snapshotConfig.SnapshotName, snapshotConfig.Cron))
+			err = schedule.apply(newSnapshotsConfigs)
+			if err != nil {
+				slog.Error("can't reload the snapshot configs: " + err.Error())
+			}
 		}
-		if err != nil {
-			slog.Error("can't create scheduler.")
-			return
+		for running := true; running; {
+			select {
+			case <-hangups:
+				slog.Info("received SIGHUP, reloading the snapshot configs")
+				reload()
+			case <-changes:
+				slog.Info("the snapshot configs changed, reloading them")
+				reload()
+			case <-ctx.Done():
+				running = false
+			}
 		}
-		scheduler.Start()
-		for {
-			time.Sleep(1 * time.Second)
+
+		slog.Info(fmt.Sprintf("shutting down, waiting up to %s for the running snapshots", gracePeriod))
+		// a second signal interrupts the running snapshots without waiting for the grace period
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			slog.Warn("interrupting the running snapshots")
+			cancelSnapshots()
+		}()
+		// no snapshot is started anymore, and the running ones are waited for up to the grace period
+		err = scheduler.Shutdown()
+		if err != nil {
+			slog.Warn(fmt.Sprintf("the running snapshots didn't complete within %s, interrupting them", gracePeriod))
 		}
+		cancelSnapshots()
+		// the interrupted snapshots delete their tmp dirs before returning
+		runningSnapshots.Wait()
+		slog.Info("shutdown complete")
+		return nil
 	},
 }
 
+// getShutdownGracePeriod returns how long the daemon waits for the running snapshots when shutting
+// down, before interrupting them.
+func getShutdownGracePeriod(config *structs.Config) (time.Duration, error) {
+	if len(config.ShutdownGracePeriod) == 0 {
+		return defaultShutdownGracePeriod, nil
+	}
+	gracePeriod, err := utils.ParseDuration(config.ShutdownGracePeriod)
+	if err != nil {
+		return 0, fmt.Errorf("invalid shutdown_grace_period: %s", err.Error())
+	}
+	return gracePeriod, nil
+}
+
+// getSnapshotsConfigsPollInterval returns how often the daemon checks if the snapshot configs changed,
+// 0 if it doesn't.
+func getSnapshotsConfigsPollInterval(config *structs.Config) (time.Duration, error) {
+	if len(config.SnapshotsConfigsPollInterval) == 0 {
+		return defaultSnapshotsConfigsPollInterval, nil
+	}
+	pollInterval, err := utils.ParseDuration(config.SnapshotsConfigsPollInterval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid snapshots_configs_poll_interval: %s", err.Error())
+	}
+	return pollInterval, nil
+}
+
+// getSnapshotInfoById returns the snapshot with an id like name.3, name.<timestamp> or name.latest.
+func getSnapshotInfoById(snapshotsConfigsDir string, expandVars bool, snapshotId string) (*structs.SnapshotInfo, error) {
+	snapshotName, selector, err := utils.SplitSnapshotId(snapshotId)
+	if err != nil {
+		return nil, err
+	}
+	snapshotConfig, err := configs.GetSnapshotConfigByName(snapshotsConfigsDir, expandVars, snapshotName)
+	if err != nil {
+		return nil, err
+	}
+	return snapshots.GetSnapshotInfo(snapshotConfig, selector)
+}
+
+// selectSnapshotsConfigs returns the snapshot configs with the given names, or all of them if no
+// name is given.
+func selectSnapshotsConfigs(snapshotsConfigs []*structs.SnapshotConfig, snapshotsNames []string) ([]*structs.SnapshotConfig, error) {
+	if len(snapshotsNames) == 0 {
+		return snapshotsConfigs, nil
+	}
+	selected := []*structs.SnapshotConfig{}
+	for _, snapshotName := range snapshotsNames {
+		sc, err := configs.FindSnapshotConfig(snapshotsConfigs, snapshotName)
+		if err != nil {
+			return nil, err
+		}
+		selected = append(selected, sc)
+	}
+	return selected, nil
+}
+
+// runOnceError is returned when some of the snapshots run with --run-once fail. Each failure is
+// logged when it happens, so only their number is in the message.
+type runOnceError struct {
+	total int
+	errs  []error
+}
+
+func (runOnceErr *runOnceError) Error() string {
+	return fmt.Sprintf("%d of %d snapshots failed", len(runOnceErr.errs), runOnceErr.total)
+}
+
+func (runOnceErr *runOnceError) Unwrap() []error {
+	return runOnceErr.errs
+}
+
+// Execute runs the command line, and exits with the status of the error if the command fails.
 func Execute() {
+	setUsageErrors(rootCmd)
 	err := rootCmd.Execute()
 	if err != nil {
-		os.Exit(1)
+		slog.Error(err.Error())
+		os.Exit(getExitCode(err))
 	}
 }
 
 func init() {
+	rootCmd.Version = utils.GetVersion()
+	rootCmd.Long += "\n\n" + exitCodesHelp
+	// the errors are logged by Execute like everything else, and the usage is printed only for --help
+	rootCmd.SilenceErrors = true
+	rootCmd.SilenceUsage = true
 	rootCmd.PersistentFlags().String("config-dir", configs.GetDefaultConfigsDir(), "Directory where config.yml is stored")
 	rootCmd.PersistentFlags().Bool("expand-vars", true, "Expand env variables in the config files")
 	rootCmd.Flags().StringArray("run-once", []string{}, "Run these snapshots once")
+	rootCmd.RegisterFlagCompletionFunc("run-once", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeSnapshotsNames(cmd, nil, toComplete)
+	})
 }
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"snapsync/configs"
+	"snapsync/structs"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+)
+
+// snapshotsSchedule keeps the jobs of the scheduler matching the snapshot configs, one job for each
+// snapshot config with a cron.
+type snapshotsSchedule struct {
+	scheduler gocron.Scheduler
+	task      func(snapshotConfig *structs.SnapshotConfig)
+	jobs      map[string]*scheduledSnapshot
+}
+
+type scheduledSnapshot struct {
+	job            gocron.Job
+	snapshotConfig *structs.SnapshotConfig
+}
+
+func newSnapshotsSchedule(scheduler gocron.Scheduler, task func(snapshotConfig *structs.SnapshotConfig)) *snapshotsSchedule {
+	return &snapshotsSchedule{
+		scheduler: scheduler,
+		task:      task,
+		jobs:      map[string]*scheduledSnapshot{},
+	}
+}
+
+// apply adds, reschedules and removes the jobs so that they match snapshotsConfigs. The runs in
+// progress are not interrupted: a rescheduled or removed snapshot completes with its old config.
+func (schedule *snapshotsSchedule) apply(snapshotsConfigs []*structs.SnapshotConfig) error {
+	snapshotsConfigsToSchedule := map[string]*structs.SnapshotConfig{}
+	for _, snapshotConfig := range snapshotsConfigs {
+		if len(snapshotConfig.Cron) == 0 {
+			continue
+		}
+		snapshotsConfigsToSchedule[snapshotConfig.SnapshotName] = snapshotConfig
+	}
+
+	for snapshotName, scheduled := range schedule.jobs {
+		if _, ok := snapshotsConfigsToSchedule[snapshotName]; ok {
+			continue
+		}
+		err := schedule.scheduler.RemoveJob(scheduled.job.ID())
+		if err != nil {
+			return fmt.Errorf("can't remove cron job for snapshot %s: %s", snapshotName, err.Error())
+		}
+		delete(schedule.jobs, snapshotName)
+		slog.Info(fmt.Sprintf("[%s] unscheduled", snapshotName))
+	}
+
+	for _, snapshotConfig := range snapshotsConfigs {
+		if _, ok := snapshotsConfigsToSchedule[snapshotConfig.SnapshotName]; !ok {
+			continue
+		}
+		scheduled, ok := schedule.jobs[snapshotConfig.SnapshotName]
+		if ok && reflect.DeepEqual(scheduled.snapshotConfig, snapshotConfig) {
+			continue
+		}
+		jobDefinition := gocron.CronJob(snapshotConfig.Cron, false)
+		task := gocron.NewTask(schedule.task, snapshotConfig)
+		// a run still in progress when the next one is due makes the next one be skipped
+		singletonMode := gocron.WithSingletonMode(gocron.LimitModeReschedule)
+		if ok {
+			job, err := schedule.scheduler.Update(scheduled.job.ID(), jobDefinition, task, singletonMode)
+			if err != nil {
+				return fmt.Errorf("can't update cron job for snapshot %s. Cron string is %s: %s", snapshotConfig.SnapshotName, snapshotConfig.Cron, err.Error())
+			}
+			schedule.jobs[snapshotConfig.SnapshotName] = &scheduledSnapshot{job: job, snapshotConfig: snapshotConfig}
+			slog.Info(fmt.Sprintf("[%s] rescheduled with cron %s", snapshotConfig.SnapshotName, snapshotConfig.Cron))
+			continue
+		}
+		job, err := schedule.scheduler.NewJob(jobDefinition, task, singletonMode)
+		if err != nil {
+			return fmt.Errorf("can't add cron job for snapshot %s. Cron string is %s: %s", snapshotConfig.SnapshotName, snapshotConfig.Cron, err.Error())
+		}
+		schedule.jobs[snapshotConfig.SnapshotName] = &scheduledSnapshot{job: job, snapshotConfig: snapshotConfig}
+		slog.Info(fmt.Sprintf("[%s] scheduled with cron %s", snapshotConfig.SnapshotName, snapshotConfig.Cron))
+	}
+	return nil
+}
+
+// loadValidSnapshotsConfigs loads the snapshot configs in snapshotsConfigsDir, failing if any of
+// them is invalid, so that a broken config never replaces a working schedule.
+func loadValidSnapshotsConfigs(snapshotsConfigsDir string, expandVars bool) ([]*structs.SnapshotConfig, error) {
+	problems := configs.ValidateSnapshotsConfigs(snapshotsConfigsDir, expandVars)
+	if len(problems) > 0 {
+		return nil, &configs.ValidationError{Problems: problems}
+	}
+	return configs.LoadSnapshotsConfigs(snapshotsConfigsDir, expandVars)
+}
+
+// watchSnapshotsConfigsDir sends to changes every time the snapshot configs in snapshotsConfigsDir
+// change, checking them every interval, until stop is closed.
+func watchSnapshotsConfigsDir(snapshotsConfigsDir string, interval time.Duration, changes chan<- struct{}, stop <-chan struct{}) {
+	lastVersion, err := configs.GetSnapshotsConfigsVersion(snapshotsConfigsDir)
+	if err != nil {
+		slog.Warn(err.Error())
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		version, err := configs.GetSnapshotsConfigsVersion(snapshotsConfigsDir)
+		if err != nil {
+			slog.Warn(err.Error())
+			continue
+		}
+		if version == lastVersion {
+			continue
+		}
+		lastVersion = version
+		select {
+		case changes <- struct{}{}:
+		default:
+			// a reload is already pending
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"snapsync/configs"
+
+	"github.com/spf13/cobra"
+)
+
+// schemaCmd represents the schema command
+var schemaCmd = &cobra.Command{
+	Use:   "schema config|snapshot",
+	Short: "Print the JSON Schema of config.yml or of the snapshot configs",
+	Long: `Print the JSON Schema of config.yml or of the snapshot configs, so that editors can validate
+and autocomplete them. For example, with the YAML language server:
+
+  snapsync schema snapshot > snapshot.schema.json
+
+and at the top of each snapshot config:
+
+  # yaml-language-server: $schema=./snapshot.schema.json`,
+	ValidArgs: []string{"config", "snapshot"},
+	Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var schema map[string]any
+		switch args[0] {
+		case "config":
+			schema = configs.GetConfigJSONSchema()
+		case "snapshot":
+			schema = configs.GetSnapshotConfigJSONSchema()
+		}
+		content, err := json.MarshalIndent(schema, "", "  ")
+		if err != nil {
+			return fmt.Errorf("can't encode the schema: %w", err)
+		}
+		fmt.Println(string(content))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"snapsync/configs"
+	"snapsync/snapshots"
+	"snapsync/utils"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status [snapshot_name...]",
+	Short: "Show the runs in progress and the last runs locked out",
+	Long: `Show, for the given snapshot configs or all of them if none is given, the run currently holding
+the lock of the snapshots dir, the last run that didn't start because of it, the latest snapshot and
+what the last completed run changed.`,
+	ValidArgsFunction: completeSnapshotsNames,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		configsDir, err := cmd.Flags().GetString("config-dir")
+		if err != nil {
+			return errors.New("can 't get configs-dir flag")
+		}
+		expandVars, err := cmd.Flags().GetBool("expand-vars")
+		if err != nil {
+			return errors.New("can 't get expand-vars flag")
+		}
+		config, err := configs.LoadConfig(configsDir, expandVars)
+		if err != nil {
+			return fmt.Errorf("can't get %s: %w", configsDir, err)
+		}
+		snapshotsConfigs, err := configs.LoadSnapshotsConfigs(config.SnapshotsConfigsDir, expandVars)
+		if err != nil {
+			return fmt.Errorf("can't get snapshots configs in %s: %w", config.SnapshotsConfigsDir, err)
+		}
+
+		snapshotsConfigsToShow, err := selectSnapshotsConfigs(snapshotsConfigs, args)
+		if err != nil {
+			return err
+		}
+
+		for _, snapshotConfig := range snapshotsConfigsToShow {
+			fmt.Printf("%s:\n", snapshotConfig.SnapshotName)
+
+			holder, err := snapshots.ReadLockHolder(snapshotConfig)
+			if err != nil {
+				fmt.Printf("  running: unknown (%s)\n", err.Error())
+			} else if holder == nil {
+				fmt.Println("  running: no")
+			} else {
+				fmt.Printf("  running: %s of %s by pid %d since %s\n", holder.Operation, holder.SnapshotName, holder.Pid, holder.Since.Format(time.RFC3339))
+			}
+
+			lockout, err := snapshots.ReadLastLockout(snapshotConfig)
+			if err != nil {
+				fmt.Printf("  last locked out: unknown (%s)\n", err.Error())
+			} else if lockout == nil {
+				fmt.Println("  last locked out: never")
+			} else if lockout.Holder != nil {
+				fmt.Printf("  last locked out: %s at %s, while pid %d was running %s of %s\n", lockout.Operation, lockout.Time.Format(time.RFC3339), lockout.Holder.Pid, lockout.Holder.Operation, lockout.Holder.SnapshotName)
+			} else {
+				fmt.Printf("  last locked out: %s at %s\n", lockout.Operation, lockout.Time.Format(time.RFC3339))
+			}
+
+			snapshotsInfo, err := snapshots.ListSnapshots(snapshotConfig)
+			if err != nil {
+				fmt.Printf("  latest snapshot: unknown (%s)\n", err.Error())
+			} else if len(snapshotsInfo) == 0 {
+				fmt.Println("  latest snapshot: none")
+			} else {
+				fmt.Printf("  latest snapshot: %s (%s)\n", snapshotsInfo[0].CompactName(), snapshotsInfo[0].Time.Format(time.RFC3339))
+			}
+
+			runsStats, err := snapshots.ReadRunStats(snapshotConfig)
+			if err != nil {
+				fmt.Printf("  last run: unknown (%s)\n", err.Error())
+			} else if len(runsStats) == 0 {
+				fmt.Println("  last run: none")
+			} else {
+				lastRun := runsStats[len(runsStats)-1]
+				total := lastRun.Total()
+				fmt.Printf("  last run: %s in %.2f s, %d files transferred (%s), %d deleted, %s in snapshot\n", lastRun.SnapshotTime.Format(time.RFC3339), total.Duration.Seconds(),
+					total.FilesTransferred, utils.HumanReadableSize(total.BytesTransferred), total.FilesDeleted, utils.HumanReadableSize(total.SnapshotBytes))
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"snapsync/configs"
+	"snapsync/snapshots"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify <name.N>",
+	Short: "Check the files of a snapshot against its checksums",
+	Long: `Hash again all the files of a snapshot, like snapsync verify daily.0, and compare them with the
+checksums computed when the snapshot was taken, that requires checksums: true in the snapshot config.
+Prints the files whose content changed, the missing files and the extra files. Since the snapshots
+share the unchanged files through hard links, a damaged file is usually damaged in the other
+snapshots too. Exits with status 1 if any file doesn't match.`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeSnapshotIds(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		configsDir, err := cmd.Flags().GetString("config-dir")
+		if err != nil {
+			return errors.New("can 't get configs-dir flag")
+		}
+		expandVars, err := cmd.Flags().GetBool("expand-vars")
+		if err != nil {
+			return errors.New("can 't get expand-vars flag")
+		}
+		output, err := getOutputFormat(cmd)
+		if err != nil {
+			return err
+		}
+		config, err := configs.LoadConfig(configsDir, expandVars)
+		if err != nil {
+			return fmt.Errorf("can't get %s: %w", configsDir, err)
+		}
+		snapshotInfo, err := getSnapshotInfoById(config.SnapshotsConfigsDir, expandVars, args[0])
+		if err != nil {
+			return err
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		report, err := snapshots.VerifySnapshot(ctx, snapshotInfo)
+		if err != nil {
+			return fmt.Errorf("can't verify %s: %w", args[0], err)
+		}
+
+		if output == outputJSON {
+			err = printJSON(report)
+			if err != nil {
+				return fmt.Errorf("can't print the report: %w", err)
+			}
+		} else {
+			for _, relPath := range report.Mismatched {
+				fmt.Printf("mismatch %s\n", relPath)
+			}
+			for _, relPath := range report.Missing {
+				fmt.Printf("missing  %s\n", relPath)
+			}
+			for _, relPath := range report.Extra {
+				fmt.Printf("extra    %s\n", relPath)
+			}
+			for _, unreadable := range report.Unreadable {
+				fmt.Printf("error    %s\n", unreadable)
+			}
+			fmt.Printf("%s: %d verified, %d mismatched, %d missing, %d extra, %d unreadable\n", report.Snapshot, report.Verified,
+				len(report.Mismatched), len(report.Missing), len(report.Extra), len(report.Unreadable))
+		}
+		if !report.OK() {
+			return fmt.Errorf("%s doesn't match its checksums", report.Snapshot)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	addOutputFlag(verifyCmd, "Output format", outputList, outputJSON)
+}
@@ -1,27 +1,50 @@
 package configs
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
 	"snapsync/structs"
+	"snapsync/utils"
 	"strings"
-
-	"gopkg.in/yaml.v3"
 )
 
+// ErrConfigNotFound is wrapped by the errors returned when config.yml or a snapshot config doesn't
+// exist.
+var ErrConfigNotFound = errors.New("config not found")
+
+// SnapshotConfigNotFoundError is returned when there is no snapshot config with the given name. It
+// wraps ErrConfigNotFound.
+type SnapshotConfigNotFoundError struct {
+	SnapshotName string
+	// KnownNames are the names of the existing snapshot configs
+	KnownNames []string
+}
+
+func (notFoundErr *SnapshotConfigNotFoundError) Error() string {
+	message := fmt.Sprintf("there is not snapshot named %s", notFoundErr.SnapshotName)
+	if suggestion, ok := utils.SuggestClosest(notFoundErr.SnapshotName, notFoundErr.KnownNames); ok {
+		return message + fmt.Sprintf(", did you mean %s?", suggestion)
+	}
+	if len(notFoundErr.KnownNames) == 0 {
+		return message + ", there are no snapshot configs"
+	}
+	return message + ", the snapshots are " + strings.Join(notFoundErr.KnownNames, ", ")
+}
+
+func (notFoundErr *SnapshotConfigNotFoundError) Unwrap() error {
+	return ErrConfigNotFound
+}
+
 func LoadConfig(configsDir string, expandVars bool) (config *structs.Config, err error) {
 	configPath := path.Join(configsDir, "config.yml")
-	configFile, err := os.ReadFile(configPath)
+	configFileContent, err := readConfigFile(configPath, expandVars)
 	if err != nil {
-		return nil, fmt.Errorf("can't read %s: %s", configPath, err.Error())
-	}
-	configFileContent := string(configFile)
-	if expandVars {
-		configFileContent = os.ExpandEnv(configFileContent)
+		return nil, err
 	}
 	config = &structs.Config{}
-	err = yaml.Unmarshal([]byte(configFileContent), config)
+	err = decodeStrict(configFileContent, config)
 	if err != nil {
 		return nil, fmt.Errorf("can't parse %s: %s", configPath, err.Error())
 	}
@@ -34,23 +57,16 @@ func LoadSnapshotsConfigs(snapshotsConfigsDir string, expandVars bool) (snapshot
 		return snapshotsConfigs, fmt.Errorf("can't read directory %s: %s", snapshotsConfigsDir, err.Error())
 	}
 	for _, snapshotConfigEntry := range snapshotConfigsEntries {
-		if strings.HasPrefix(snapshotConfigEntry.Name(), "config.yml") {
-			continue
-		}
-		if !strings.HasSuffix(snapshotConfigEntry.Name(), ".yml") {
+		if !isSnapshotConfigFile(snapshotConfigEntry.Name()) {
 			continue
 		}
 		absPath := path.Join(snapshotsConfigsDir, snapshotConfigEntry.Name())
-		snapshotConfigFile, err := os.ReadFile(absPath)
+		configFileContent, err := readConfigFile(absPath, expandVars)
 		if err != nil {
-			return snapshotsConfigs, fmt.Errorf("can't read snapshot config file %s: %s", absPath, err.Error())
-		}
-		configFileContent := string(snapshotConfigFile)
-		if expandVars {
-			configFileContent = os.ExpandEnv(configFileContent)
+			return snapshotsConfigs, err
 		}
 		snapshotConfig := structs.SnapshotConfig{}
-		err = yaml.Unmarshal([]byte(configFileContent), &snapshotConfig)
+		err = decodeStrict(configFileContent, &snapshotConfig)
 		if err != nil {
 			return snapshotsConfigs, fmt.Errorf("can't parse snapshot config file %s: %s", absPath, err.Error())
 		}
@@ -74,11 +90,44 @@ func LoadSnapshotsConfigs(snapshotsConfigsDir string, expandVars bool) (snapshot
 	return snapshotsConfigs, nil
 }
 
-func ValidateSnapshotConfig(snapshotConfig *structs.SnapshotConfig) error {
-	if strings.Contains(snapshotConfig.SnapshotName, ".") || strings.Contains(snapshotConfig.SnapshotName, " ") {
-		return fmt.Errorf("snapshot %s'sname must not include dots or whitespaces", snapshotConfig.SnapshotName)
+// GetSnapshotsConfigsVersion returns a string that changes whenever a snapshot config file in
+// snapshotsConfigsDir is added, removed or modified.
+func GetSnapshotsConfigsVersion(snapshotsConfigsDir string) (string, error) {
+	snapshotConfigsEntries, err := os.ReadDir(snapshotsConfigsDir)
+	if err != nil {
+		return "", fmt.Errorf("can't read directory %s: %s", snapshotsConfigsDir, err.Error())
 	}
-	return nil
+	version := strings.Builder{}
+	for _, snapshotConfigEntry := range snapshotConfigsEntries {
+		if !isSnapshotConfigFile(snapshotConfigEntry.Name()) {
+			continue
+		}
+		info, err := snapshotConfigEntry.Info()
+		if err != nil {
+			return "", fmt.Errorf("can't stat %s: %s", path.Join(snapshotsConfigsDir, snapshotConfigEntry.Name()), err.Error())
+		}
+		fmt.Fprintf(&version, "%s:%d:%d\n", snapshotConfigEntry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return version.String(), nil
+}
+
+// readConfigFile reads the config file at filePath, expanding the env variables in it if expandVars is set.
+func readConfigFile(filePath string, expandVars bool) ([]byte, error) {
+	content, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s doesn't exist", ErrConfigNotFound, filePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %s", filePath, err.Error())
+	}
+	if expandVars {
+		return []byte(os.ExpandEnv(string(content))), nil
+	}
+	return content, nil
+}
+
+func isSnapshotConfigFile(fileName string) bool {
+	return !strings.HasPrefix(fileName, "config.yml") && strings.HasSuffix(fileName, ".yml")
 }
 
 func GetDefaultConfigsDir() string {
@@ -86,15 +135,25 @@ func GetDefaultConfigsDir() string {
 	return result
 }
 
+// GetSnapshotConfigByName loads the snapshot config named snapshotName. The returned error is a
+// *SnapshotConfigNotFoundError if there is none.
 func GetSnapshotConfigByName(snapshotsConfigsDir string, expandVars bool, snapshotName string) (*structs.SnapshotConfig, error) {
 	snapshotConfigs, err := LoadSnapshotsConfigs(snapshotsConfigsDir, expandVars)
 	if err != nil {
 		return nil, err
 	}
-	for _, snapshotConfig := range snapshotConfigs {
+	return FindSnapshotConfig(snapshotConfigs, snapshotName)
+}
+
+// FindSnapshotConfig returns the snapshot config named snapshotName among snapshotsConfigs. The
+// returned error is a *SnapshotConfigNotFoundError if there is none.
+func FindSnapshotConfig(snapshotsConfigs []*structs.SnapshotConfig, snapshotName string) (*structs.SnapshotConfig, error) {
+	knownNames := []string{}
+	for _, snapshotConfig := range snapshotsConfigs {
 		if snapshotConfig.SnapshotName == snapshotName {
 			return snapshotConfig, nil
 		}
+		knownNames = append(knownNames, snapshotConfig.SnapshotName)
 	}
-	return nil, nil
+	return nil, &SnapshotConfigNotFoundError{SnapshotName: snapshotName, KnownNames: knownNames}
 }
@@ -0,0 +1,111 @@
+package configs
+
+import (
+	"reflect"
+	"snapsync/structs"
+)
+
+// the patterns of the durations accepted by utils.ParseDuration: either a time.ParseDuration duration,
+// with sign, fractions and units up to hours, or integers with units up to years. The positive ones
+// have a value that isn't zero in at least one of their parts.
+const (
+	goDurationUnitPattern         = `(ns|us|µs|μs|ms|s|m|h)`
+	goDurationPartPattern         = `([0-9]+(\.[0-9]*)?|\.[0-9]+)` + goDurationUnitPattern
+	goPositiveDurationPartPattern = `([0-9]*[1-9][0-9]*(\.[0-9]*)?|[0-9]*\.[0-9]*[1-9][0-9]*)` + goDurationUnitPattern
+	goDurationPattern             = `[-+]?(0|(` + goDurationPartPattern + `)+)`
+	goPositiveDurationPattern     = `\+?(` + goDurationPartPattern + `)*` + goPositiveDurationPartPattern + `(` + goDurationPartPattern + `)*`
+	daysDurationPattern           = `([0-9]+[smhdwy])+`
+	daysPositiveDurationPattern   = `([0-9]+[smhdwy])*[0-9]*[1-9][0-9]*[smhdwy]([0-9]+[smhdwy])*`
+)
+
+var durationSchema = map[string]any{
+	"description": "A duration like 90s, 12h, 7d or 1w2d",
+	"pattern":     "^(" + goDurationPattern + "|" + daysDurationPattern + ")$",
+}
+
+var positiveDurationSchema = map[string]any{
+	"description": "A duration greater than 0 like 90s, 12h, 7d or 1w2d",
+	"pattern":     "^(" + goPositiveDurationPattern + "|" + daysPositiveDurationPattern + ")$",
+}
+
+// the schemas of the fields that must be more specific than their Go type, by type and YAML key
+var fieldsSchemas = map[string]map[string]any{
+	"structs.Config.shutdown_grace_period":           durationSchema,
+	"structs.Config.snapshots_configs_poll_interval": durationSchema,
+	"structs.SnapshotConfig.lock_policy":             {"enum": structs.LockPolicies},
+	"structs.SnapshotConfig.lock_timeout":            durationSchema,
+	"structs.SnapshotConfig.clone_engine":            {"enum": structs.CloneEngines},
+	"structs.SnapshotConfig.naming":                  {"enum": structs.Namings},
+	"structs.SnapshotConfig.sync_engine":             {"enum": structs.SyncEngines},
+	"structs.SnapshotConfig.retention":               {"minimum": 0},
+	"structs.RetentionPolicy.keep_within":            positiveDurationSchema,
+}
+
+var requiredFields = map[string][]string{
+	"structs.Config":         {"snapshots_configs_dir"},
+	"structs.SnapshotConfig": {"snapshot_name", "dirs", "snapshots_dir"},
+	"structs.SnapshotDir":    {"src_dir_abspath"},
+}
+
+// GetConfigJSONSchema returns the JSON Schema of config.yml.
+func GetConfigJSONSchema() map[string]any {
+	return getJSONSchema(reflect.TypeOf(structs.Config{}), "snapsync config")
+}
+
+// GetSnapshotConfigJSONSchema returns the JSON Schema of the snapshot config files.
+func GetSnapshotConfigJSONSchema() map[string]any {
+	return getJSONSchema(reflect.TypeOf(structs.SnapshotConfig{}), "snapsync snapshot config")
+}
+
+func getJSONSchema(t reflect.Type, title string) map[string]any {
+	schema := getTypeJSONSchema(t)
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = title
+	return schema
+}
+
+// getTypeJSONSchema returns the schema of the YAML values decoded into the type t. The objects don't
+// allow additional properties, since the files are decoded rejecting the unknown keys.
+func getTypeJSONSchema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return getTypeJSONSchema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": getTypeJSONSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": getTypeJSONSchema(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]any{}
+		for i := 0; i < t.NumField(); i++ {
+			name, ok := getYAMLFieldName(t.Field(i))
+			if !ok {
+				continue
+			}
+			fieldSchema := getTypeJSONSchema(t.Field(i).Type)
+			for key, value := range fieldsSchemas[t.String()+"."+name] {
+				fieldSchema[key] = value
+			}
+			properties[name] = fieldSchema
+		}
+		schema := map[string]any{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if required, ok := requiredFields[t.String()]; ok {
+			schema["required"] = required
+		}
+		return schema
+	default:
+		return map[string]any{}
+	}
+}
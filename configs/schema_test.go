@@ -0,0 +1,29 @@
+package configs
+
+import (
+	"regexp"
+	"snapsync/utils"
+	"testing"
+)
+
+// testDurations are valid and invalid durations, for both time.ParseDuration and the days units.
+var testDurations = []string{
+	"0", "+0", "-0", "0s", "00h", "0h0m", "0.0s", "0d", "0w0d",
+	"1s", "90s", "12h", "1h30m", "1.5h", ".5h", "1.h", "-1h", "+2m", "-1.5h", "300ms", "10us", "10µs", "10μs", "5ns",
+	"7d", "1w2d", "1y", "1y12h", "10d0h", "0d1h", "00d01s",
+	"", "1", "h", "1.5d", "1d30ms", "1d1.5h", "-1d", "+1d", "1d-1h", "1q", "1 h", "1H", "1D", "d1", "1..5h", ".h", "1hh", "1.5", "1e3s",
+}
+
+func TestDurationSchemaMatchesParseDuration(t *testing.T) {
+	durationRegex := regexp.MustCompile(durationSchema["pattern"].(string))
+	positiveDurationRegex := regexp.MustCompile(positiveDurationSchema["pattern"].(string))
+	for _, durationString := range testDurations {
+		duration, err := utils.ParseDuration(durationString)
+		if matches := durationRegex.MatchString(durationString); matches != (err == nil) {
+			t.Errorf("the duration pattern matches %q: %t, but ParseDuration returned %v", durationString, matches, err)
+		}
+		if matches := positiveDurationRegex.MatchString(durationString); matches != (err == nil && duration > 0) {
+			t.Errorf("the positive duration pattern matches %q: %t, but ParseDuration returned %s, %v", durationString, matches, duration, err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package configs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"snapsync/utils"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var unknownFieldRegex = regexp.MustCompile(`field (\S+) not found in type (\S+)`)
+
+// decodeStrict decodes the YAML content into out, failing on the keys that don't match any field of
+// out instead of ignoring them, so that a typo doesn't silently leave a setting to its default.
+// The errors about unknown keys suggest the closest known key.
+func decodeStrict(content []byte, out any) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	err := decoder.Decode(out)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	typeError, ok := err.(*yaml.TypeError)
+	if !ok {
+		return err
+	}
+	knownFields := map[string][]string{}
+	collectYAMLFields(reflect.TypeOf(out), knownFields)
+	for i, message := range typeError.Errors {
+		match := unknownFieldRegex.FindStringSubmatch(message)
+		if match == nil {
+			continue
+		}
+		message = strings.Replace(message, match[0], "unknown field "+match[1], 1)
+		if suggestion, ok := utils.SuggestClosest(match[1], knownFields[match[2]]); ok {
+			message += fmt.Sprintf(", did you mean %s?", suggestion)
+		}
+		typeError.Errors[i] = message
+	}
+	return typeError
+}
+
+// collectYAMLFields maps the name of each struct type reachable from t, as printed by the YAML
+// decoder, to the YAML keys of its fields.
+func collectYAMLFields(t reflect.Type, knownFields map[string][]string) {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return
+	}
+	if _, ok := knownFields[t.String()]; ok {
+		return
+	}
+	// set before recursing, in case the type contains itself
+	knownFields[t.String()] = nil
+	fields := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := getYAMLFieldName(t.Field(i))
+		if !ok {
+			continue
+		}
+		fields = append(fields, name)
+		collectYAMLFields(t.Field(i).Type, knownFields)
+	}
+	knownFields[t.String()] = fields
+}
+
+// getYAMLFieldName returns the key of field in the YAML files, and false if the field isn't decoded.
+func getYAMLFieldName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() {
+		return "", false
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return "", false
+	}
+	if len(name) == 0 {
+		name = strings.ToLower(field.Name)
+	}
+	return name, true
+}
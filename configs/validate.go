@@ -0,0 +1,346 @@
+package configs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"snapsync/structs"
+	"snapsync/utils"
+	"strconv"
+	"strings"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationProblem is a problem found in a config file. Line is 0 when the problem isn't related to
+// a line, like a missing key.
+type ValidationProblem struct {
+	File    string
+	Line    int
+	Field   string
+	Message string
+}
+
+func (problem *ValidationProblem) String() string {
+	location := problem.File
+	if problem.Line > 0 {
+		location = fmt.Sprintf("%s:%d", location, problem.Line)
+	}
+	if len(problem.Field) > 0 {
+		return fmt.Sprintf("%s: %s: %s", location, problem.Field, problem.Message)
+	}
+	return fmt.Sprintf("%s: %s", location, problem.Message)
+}
+
+// ValidationError lists all the problems found in the configs.
+type ValidationError struct {
+	Problems []*ValidationProblem
+}
+
+func (validationError *ValidationError) Error() string {
+	problems := make([]string, len(validationError.Problems))
+	for i, problem := range validationError.Problems {
+		problems[i] = problem.String()
+	}
+	return fmt.Sprintf("%d problems in the configs: %s", len(problems), strings.Join(problems, "; "))
+}
+
+// validator collects the problems of a config file, finding the line of each problem in the YAML
+// tree of the file, if there is one.
+type validator struct {
+	file     string
+	root     *yaml.Node
+	problems []*ValidationProblem
+}
+
+var yamlLineRegex = regexp.MustCompile(`line ([0-9]+): `)
+
+// add records a problem of field, a path like dirs[1].dst_dir_in_snapshot, or of the whole file if
+// field is empty.
+func (v *validator) add(field string, format string, args ...any) {
+	v.problems = append(v.problems, &ValidationProblem{
+		File:    v.file,
+		Line:    findFieldLine(v.root, field),
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// addYAMLError records the errors returned by the YAML decoder, one problem for each line they report.
+func (v *validator) addYAMLError(err error) {
+	messages := []string{err.Error()}
+	if typeError, ok := err.(*yaml.TypeError); ok {
+		messages = typeError.Errors
+	}
+	for _, message := range messages {
+		message = strings.TrimPrefix(message, "yaml: ")
+		line := 0
+		if match := yamlLineRegex.FindStringSubmatch(message); match != nil {
+			line, _ = strconv.Atoi(match[1])
+			message = strings.Replace(message, match[0], "", 1)
+		}
+		v.problems = append(v.problems, &ValidationProblem{File: v.file, Line: line, Message: message})
+	}
+}
+
+// findFieldLine returns the line of the value of field in the YAML tree rooted at root. If the field is
+// missing, the line of its closest parent is returned, or 0 if not even the first key exists.
+func findFieldLine(root *yaml.Node, field string) int {
+	if root == nil || len(field) == 0 {
+		return 0
+	}
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := 0
+	for _, part := range strings.Split(field, ".") {
+		key, indexes, _ := strings.Cut(part, "[")
+		node = findMappingValue(node, key)
+		if node == nil {
+			return line
+		}
+		line = node.Line
+		for _, index := range strings.Split(strings.TrimSuffix(indexes, "]"), "][") {
+			if len(index) == 0 {
+				continue
+			}
+			i, err := strconv.Atoi(index)
+			if err != nil || node.Kind != yaml.SequenceNode || i >= len(node.Content) {
+				return line
+			}
+			node = node.Content[i]
+			line = node.Line
+		}
+	}
+	return line
+}
+
+func findMappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// decodeConfigFile parses the config file at filePath into out, keeping the YAML tree of the file in v
+// so that the problems found later can be related to their lines. It returns false if the file
+// can't be decoded, after recording why.
+func decodeConfigFile(v *validator, filePath string, expandVars bool, out any) bool {
+	content, err := readConfigFile(filePath, expandVars)
+	if err != nil {
+		v.add("", "%s", err.Error())
+		return false
+	}
+	root := &yaml.Node{}
+	err = yaml.Unmarshal(content, root)
+	if err != nil {
+		v.addYAMLError(err)
+		return false
+	}
+	v.root = root
+	if len(root.Content) == 0 {
+		v.add("", "the file is empty")
+		return false
+	}
+	err = decodeStrict(content, out)
+	if err != nil {
+		v.addYAMLError(err)
+		// the unknown keys and the values of the wrong type are skipped, the other fields are still
+		// decoded, so they are validated too to report all the problems at once
+		var typeError *yaml.TypeError
+		if !errors.As(err, &typeError) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateConfigs validates config.yml in configsDir and all the snapshot configs, returning all the
+// problems found.
+func ValidateConfigs(configsDir string, expandVars bool) []*ValidationProblem {
+	configPath := path.Join(configsDir, "config.yml")
+	v := &validator{file: configPath}
+	config := &structs.Config{}
+	if !decodeConfigFile(v, configPath, expandVars, config) {
+		return v.problems
+	}
+	validateConfig(v, config)
+	if len(config.SnapshotsConfigsDir) == 0 {
+		return v.problems
+	}
+	return append(v.problems, ValidateSnapshotsConfigs(config.SnapshotsConfigsDir, expandVars)...)
+}
+
+func validateConfig(v *validator, config *structs.Config) {
+	if len(config.SnapshotsConfigsDir) == 0 {
+		v.add("snapshots_configs_dir", "is required")
+	}
+	validateDuration(v, "shutdown_grace_period", config.ShutdownGracePeriod)
+	validateDuration(v, "snapshots_configs_poll_interval", config.SnapshotsConfigsPollInterval)
+}
+
+// ValidateSnapshotsConfigs validates all the snapshot configs in snapshotsConfigsDir, returning all the
+// problems found.
+func ValidateSnapshotsConfigs(snapshotsConfigsDir string, expandVars bool) []*ValidationProblem {
+	entries, err := os.ReadDir(snapshotsConfigsDir)
+	if err != nil {
+		return []*ValidationProblem{{File: snapshotsConfigsDir, Message: fmt.Sprintf("can't read directory: %s", err.Error())}}
+	}
+	problems := []*ValidationProblem{}
+	// the file of each snapshot name, to find the names used twice
+	snapshotsNames := map[string]string{}
+	for _, entry := range entries {
+		if !isSnapshotConfigFile(entry.Name()) {
+			continue
+		}
+		v := &validator{file: path.Join(snapshotsConfigsDir, entry.Name())}
+		snapshotConfig := &structs.SnapshotConfig{}
+		if decodeConfigFile(v, v.file, expandVars, snapshotConfig) {
+			validateSnapshotConfig(v, snapshotConfig)
+			if otherFile, ok := snapshotsNames[snapshotConfig.SnapshotName]; ok && len(snapshotConfig.SnapshotName) > 0 {
+				v.add("snapshot_name", "%s is also the name of the snapshot in %s", snapshotConfig.SnapshotName, otherFile)
+			}
+			snapshotsNames[snapshotConfig.SnapshotName] = entry.Name()
+		}
+		problems = append(problems, v.problems...)
+	}
+	return problems
+}
+
+// ValidateSnapshotConfig validates a snapshot config that was already loaded, so the returned error
+// doesn't tell the lines of the problems.
+func ValidateSnapshotConfig(snapshotConfig *structs.SnapshotConfig) error {
+	v := &validator{file: snapshotConfig.SnapshotName}
+	validateSnapshotConfig(v, snapshotConfig)
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+func validateSnapshotConfig(v *validator, snapshotConfig *structs.SnapshotConfig) {
+	if len(snapshotConfig.SnapshotName) == 0 {
+		v.add("snapshot_name", "is required")
+	} else if strings.ContainsAny(snapshotConfig.SnapshotName, ". \t\n/") {
+		v.add("snapshot_name", "%s must not include dots, slashes or whitespaces", snapshotConfig.SnapshotName)
+	}
+
+	if len(snapshotConfig.SnapshotsDir) == 0 {
+		v.add("snapshots_dir", "is required")
+	}
+
+	if len(snapshotConfig.Dirs) == 0 {
+		v.add("dirs", "at least a directory to snapshot is required")
+	}
+	dstDirs := make([]string, len(snapshotConfig.Dirs))
+	for i, dir := range snapshotConfig.Dirs {
+		field := fmt.Sprintf("dirs[%d]", i)
+		if len(dir.SrcDirAbspath) == 0 {
+			v.add(field+".src_dir_abspath", "is required")
+		} else if !path.IsAbs(dir.SrcDirAbspath) {
+			v.add(field+".src_dir_abspath", "%s must be an absolute path", dir.SrcDirAbspath)
+		}
+		// the destination is always inside the snapshot, even if it starts with a slash
+		dstDirs[i] = path.Clean("/" + dir.DstDirInSnapshot)
+		if strings.Contains("/"+dir.DstDirInSnapshot+"/", "/../") {
+			v.add(field+".dst_dir_in_snapshot", "%s must not contain ..", dir.DstDirInSnapshot)
+			continue
+		}
+		for j := 0; j < i; j++ {
+			if isSameOrInside(dstDirs[i], dstDirs[j]) || isSameOrInside(dstDirs[j], dstDirs[i]) {
+				v.add(field+".dst_dir_in_snapshot", "%s overlaps with the dst_dir_in_snapshot %s of dirs[%d]", dir.DstDirInSnapshot, snapshotConfig.Dirs[j].DstDirInSnapshot, j)
+			}
+		}
+	}
+
+	if snapshotConfig.RetentionPolicy == nil {
+		if snapshotConfig.Retention <= 0 {
+			v.add("retention", "must be greater than 0, or a retention_policy must be set")
+		}
+	} else {
+		validateRetentionPolicy(v, snapshotConfig.RetentionPolicy)
+	}
+
+	if len(snapshotConfig.Cron) > 0 {
+		_, err := cron.ParseStandard(snapshotConfig.Cron)
+		if err != nil {
+			v.add("cron", "%s is invalid: %s", snapshotConfig.Cron, err.Error())
+		}
+	}
+
+	validateOneOf(v, "lock_policy", snapshotConfig.LockPolicy, structs.LockPolicies)
+	validateDuration(v, "lock_timeout", snapshotConfig.LockTimeout)
+	validateOneOf(v, "clone_engine", snapshotConfig.CloneEngine, structs.CloneEngines)
+	validateOneOf(v, "naming", snapshotConfig.Naming, structs.Namings)
+	validateOneOf(v, "sync_engine", snapshotConfig.SyncEngine, structs.SyncEngines)
+}
+
+func validateRetentionPolicy(v *validator, policy *structs.RetentionPolicy) {
+	counts := []struct {
+		field string
+		value int
+	}{
+		{"keep_last", policy.KeepLast},
+		{"keep_hourly", policy.KeepHourly},
+		{"keep_daily", policy.KeepDaily},
+		{"keep_weekly", policy.KeepWeekly},
+		{"keep_monthly", policy.KeepMonthly},
+		{"keep_yearly", policy.KeepYearly},
+	}
+	keepsAny := false
+	if len(policy.KeepWithin) > 0 {
+		keepWithin, err := utils.ParseDuration(policy.KeepWithin)
+		if err != nil {
+			v.add("retention_policy.keep_within", "%s", err.Error())
+		} else if keepWithin <= 0 {
+			v.add("retention_policy.keep_within", "%s must be a positive duration", policy.KeepWithin)
+		} else {
+			keepsAny = true
+		}
+	}
+	for _, count := range counts {
+		if count.value < 0 {
+			v.add("retention_policy."+count.field, "must not be negative")
+		}
+		keepsAny = keepsAny || count.value > 0
+	}
+	if !keepsAny {
+		v.add("retention_policy", "doesn't keep any snapshot")
+	}
+}
+
+func validateDuration(v *validator, field string, value string) {
+	if len(value) == 0 {
+		return
+	}
+	_, err := utils.ParseDuration(value)
+	if err != nil {
+		v.add(field, "%s", err.Error())
+	}
+}
+
+func validateOneOf(v *validator, field string, value string, allowed []string) {
+	if len(value) == 0 {
+		return
+	}
+	for _, allowedValue := range allowed {
+		if value == allowedValue {
+			return
+		}
+	}
+	v.add(field, "%s is not one of %s", value, strings.Join(allowed, ", "))
+}
+
+// isSameOrInside tells if the clean absolute path dir is parent itself or is inside it.
+func isSameOrInside(dir string, parent string) bool {
+	return dir == parent || parent == "/" || strings.HasPrefix(dir, parent+"/")
+}
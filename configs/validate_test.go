@@ -0,0 +1,251 @@
+package configs
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// testProblem is an expected problem: its line, its field and a part of its message.
+type testProblem struct {
+	line    int
+	field   string
+	message string
+}
+
+// writeTestConfigs writes the files in dir, by name.
+func writeTestConfigs(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertProblems(t *testing.T, problems []*ValidationProblem, want []testProblem) {
+	t.Helper()
+	for i := 0; i < len(problems) || i < len(want); i++ {
+		if i >= len(want) {
+			t.Errorf("unexpected problem %s", problems[i].String())
+			continue
+		}
+		if i >= len(problems) {
+			t.Errorf("missing problem at line %d of %s: %s", want[i].line, want[i].field, want[i].message)
+			continue
+		}
+		problem := problems[i]
+		if problem.Line != want[i].line || problem.Field != want[i].field || !strings.Contains(problem.Message, want[i].message) {
+			t.Errorf("got the problem %s, want line %d of %s: %s", problem.String(), want[i].line, want[i].field, want[i].message)
+		}
+	}
+}
+
+const testSnapshotConfig = `snapshot_name: home
+snapshots_dir: /snapshots
+retention: 3
+cron: "0 * * * *"
+dirs:
+  - src_dir_abspath: /home/a
+    dst_dir_in_snapshot: a
+  - src_dir_abspath: /home/b
+    dst_dir_in_snapshot: b
+`
+
+func TestValidateSnapshotsConfigs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []testProblem
+	}{
+		{
+			name:   "valid",
+			config: testSnapshotConfig,
+		},
+		{
+			name:   "relative src",
+			config: strings.Replace(testSnapshotConfig, "/home/b", "home/b", 1),
+			want:   []testProblem{{8, "dirs[1].src_dir_abspath", "home/b must be an absolute path"}},
+		},
+		{
+			name:   "dst with ..",
+			config: strings.Replace(testSnapshotConfig, "dst_dir_in_snapshot: a", "dst_dir_in_snapshot: a/../../etc", 1),
+			want:   []testProblem{{7, "dirs[0].dst_dir_in_snapshot", "must not contain .."}},
+		},
+		{
+			name:   "dst inside another dst",
+			config: strings.Replace(testSnapshotConfig, "dst_dir_in_snapshot: b", "dst_dir_in_snapshot: /a/b/", 1),
+			want:   []testProblem{{9, "dirs[1].dst_dir_in_snapshot", "/a/b/ overlaps with the dst_dir_in_snapshot a of dirs[0]"}},
+		},
+		{
+			name:   "dst containing another dst",
+			config: strings.Replace(testSnapshotConfig, "dst_dir_in_snapshot: b", "dst_dir_in_snapshot: /", 1),
+			want:   []testProblem{{9, "dirs[1].dst_dir_in_snapshot", "overlaps with the dst_dir_in_snapshot a of dirs[0]"}},
+		},
+		{
+			name:   "dst sharing a prefix",
+			config: strings.Replace(testSnapshotConfig, "dst_dir_in_snapshot: b", "dst_dir_in_snapshot: ab", 1),
+		},
+		{
+			name:   "invalid cron",
+			config: strings.Replace(testSnapshotConfig, `"0 * * * *"`, `"0 * * *"`, 1),
+			want:   []testProblem{{4, "cron", "0 * * * is invalid"}},
+		},
+		{
+			name: "enums and durations",
+			config: testSnapshotConfig + `lock_policy: retry
+lock_timeout: 1.5d
+clone_engine: copy
+naming: date
+sync_engine: native
+`,
+			want: []testProblem{
+				{10, "lock_policy", "retry is not one of skip, queue, wait"},
+				{11, "lock_timeout", "1.5d"},
+				{12, "clone_engine", "copy is not one of"},
+				{13, "naming", "date is not one of index, timestamp"},
+			},
+		},
+		{
+			name: "retention policy",
+			config: strings.Replace(testSnapshotConfig, "retention: 3\n", `retention_policy:
+  keep_daily: -1
+  keep_within: 0s
+`, 1),
+			want: []testProblem{
+				{5, "retention_policy.keep_within", "0s must be a positive duration"},
+				{4, "retention_policy.keep_daily", "must not be negative"},
+				{4, "retention_policy", "doesn't keep any snapshot"},
+			},
+		},
+		{
+			name: "missing fields",
+			config: `snapshots_dir: /snapshots
+`,
+			want: []testProblem{
+				{0, "snapshot_name", "is required"},
+				{0, "dirs", "at least a directory"},
+				{0, "retention", "must be greater than 0"},
+			},
+		},
+		{
+			name:   "missing field of a dir",
+			config: strings.Replace(testSnapshotConfig, "  - src_dir_abspath: /home/b\n    dst_dir_in_snapshot: b", "  - dst_dir_in_snapshot: b", 1),
+			want:   []testProblem{{8, "dirs[1].src_dir_abspath", "is required"}},
+		},
+		{
+			name:   "unknown keys and wrong types are reported with the other problems",
+			config: strings.Replace(testSnapshotConfig, "retention: 3", "retention: many\nretenton: 3", 1) + "naming: date\n",
+			want: []testProblem{
+				{3, "", "cannot unmarshal !!str `many` into int"},
+				{4, "", "unknown field retenton, did you mean retention?"},
+				{3, "retention", "must be greater than 0"},
+				{11, "naming", "date is not one of"},
+			},
+		},
+		{
+			name:   "invalid YAML",
+			config: "snapshot_name: home\ndirs: [\n",
+			want:   []testProblem{{2, "", "did not find expected node content"}},
+		},
+		{
+			name:   "empty",
+			config: "",
+			want:   []testProblem{{0, "", "the file is empty"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestConfigs(t, dir, map[string]string{"home.yml": test.config})
+			problems := ValidateSnapshotsConfigs(dir, false)
+			for _, problem := range problems {
+				if problem.File != path.Join(dir, "home.yml") {
+					t.Errorf("the problem %s is reported in %s", problem.String(), problem.File)
+				}
+			}
+			assertProblems(t, problems, test.want)
+		})
+	}
+}
+
+func TestValidateSnapshotsConfigsDuplicateNames(t *testing.T) {
+	dir := t.TempDir()
+	writeTestConfigs(t, dir, map[string]string{
+		"a.yml":           testSnapshotConfig,
+		"b.yml":           "# the same snapshot name as a.yml\n" + testSnapshotConfig,
+		"config.yml":      "snapshots_configs_dir: " + dir,
+		"notes.txt":       "not a config",
+		"config.yml.orig": "not a snapshot config",
+	})
+	problems := ValidateSnapshotsConfigs(dir, false)
+	assertProblems(t, problems, []testProblem{{2, "snapshot_name", "home is also the name of the snapshot in a.yml"}})
+	if len(problems) > 0 && problems[0].File != path.Join(dir, "b.yml") {
+		t.Errorf("the duplicate name is reported in %s, want b.yml", problems[0].File)
+	}
+}
+
+func TestValidationProblemString(t *testing.T) {
+	tests := []struct {
+		problem *ValidationProblem
+		want    string
+	}{
+		{&ValidationProblem{File: "a.yml", Line: 3, Field: "cron", Message: "is invalid"}, "a.yml:3: cron: is invalid"},
+		{&ValidationProblem{File: "a.yml", Field: "dirs", Message: "is required"}, "a.yml: dirs: is required"},
+		{&ValidationProblem{File: "a.yml", Line: 1, Message: "the file is empty"}, "a.yml:1: the file is empty"},
+	}
+	for _, test := range tests {
+		if got := test.problem.String(); got != test.want {
+			t.Errorf("String() = %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestFindFieldLine(t *testing.T) {
+	root := &yaml.Node{}
+	err := yaml.Unmarshal([]byte(`snapshot_name: home
+retention_policy:
+  keep_daily: 7
+dirs:
+  - src_dir_abspath: /home/a
+    excludes:
+      - "*.log"
+      - cache
+  -
+    src_dir_abspath: /home/b
+`), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		field string
+		want  int
+	}{
+		{"snapshot_name", 1},
+		{"retention_policy.keep_daily", 3},
+		{"dirs", 5},
+		{"dirs[0].src_dir_abspath", 5},
+		{"dirs[0].excludes[1]", 8},
+		{"dirs[1]", 10},
+		{"dirs[1].src_dir_abspath", 10},
+		// the missing fields get the line of their closest parent
+		{"retention_policy.keep_weekly", 3},
+		{"dirs[1].dst_dir_in_snapshot", 10},
+		{"dirs[2].src_dir_abspath", 5},
+		{"dirs[x]", 5},
+		{"snapshot_name[0]", 1},
+		{"cron", 0},
+		{"", 0},
+	}
+	for _, test := range tests {
+		if got := findFieldLine(root, test.field); got != test.want {
+			t.Errorf("findFieldLine(%q) = %d, want %d", test.field, got, test.want)
+		}
+	}
+	if got := findFieldLine(nil, "snapshot_name"); got != 0 {
+		t.Errorf("findFieldLine without a tree = %d, want 0", got)
+	}
+}
@@ -3,13 +3,17 @@ module snapsync
 go 1.22.1
 
 require (
-	github.com/go-co-op/gocron/v2 v2.2.5 // indirect
+	github.com/go-co-op/gocron/v2 v2.2.5
+	github.com/robfig/cron/v3 v3.0.1
+	github.com/spf13/cobra v1.8.0
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/sys v0.9.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/jonboulle/clockwork v0.4.0 // indirect
-	github.com/robfig/cron/v3 v3.0.1 // indirect
-	github.com/spf13/cobra v1.8.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/exp v0.0.0-20231219180239-dc181d75b848 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,256 @@
+package snapshots
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"snapsync/structs"
+	"strings"
+)
+
+// ChecksumsFileName is the name of the checksums of the files of a snapshot, in the root of the
+// snapshot. It has the format of sha256sum, so that it can be checked with sha256sum -c too.
+const ChecksumsFileName = ".snapsync.sha256"
+
+// metadataFiles are the files written by snapsync in the root of the snapshots, that are not part of
+// the snapshotted files.
+var metadataFiles = []string{structs.ManifestFileName, ChecksumsFileName}
+
+func isMetadataFile(relPath string) bool {
+	return slices.Contains(metadataFiles, relPath)
+}
+
+// VerifyReport lists the files of a snapshot that don't match its checksums.
+type VerifyReport struct {
+	Snapshot string `json:"snapshot"`
+	// Verified is the number of files whose content matches the checksum
+	Verified int `json:"verified"`
+	// Mismatched are the files whose content changed since the snapshot was taken
+	Mismatched []string `json:"mismatched"`
+	// Missing are the files with a checksum that don't exist anymore
+	Missing []string `json:"missing"`
+	// Extra are the files without a checksum
+	Extra []string `json:"extra"`
+	// Unreadable are the files that couldn't be hashed, with the reason
+	Unreadable []string `json:"unreadable"`
+}
+
+// OK tells if all the files of the snapshot match their checksums.
+func (report *VerifyReport) OK() bool {
+	return len(report.Mismatched) == 0 && len(report.Missing) == 0 && len(report.Extra) == 0 && len(report.Unreadable) == 0
+}
+
+// computeChecksums hashes the regular files of the snapshot at snapshotPath. The checksums of the
+// files that are still hard linked to the same file of previousPath, the snapshot it was cloned
+// from, are reused, so only the files written by the sync are read. It returns the checksums by
+// path relative to the snapshot, and how many of them were reused.
+func computeChecksums(ctx context.Context, snapshotPath string, previousPath string) (map[string]string, int, error) {
+	previousChecksums := map[string]string{}
+	if len(previousPath) > 0 {
+		var err error
+		previousChecksums, err = readChecksums(previousPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, 0, err
+		}
+	}
+	checksums := map[string]string{}
+	reused := 0
+	err := walkSnapshotFiles(snapshotPath, func(filePath string, relPath string, info fs.FileInfo) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if checksum, ok := previousChecksums[relPath]; ok {
+			previousInfo, err := os.Lstat(path.Join(previousPath, relPath))
+			if err == nil && getFileID(previousInfo) == getFileID(info) {
+				checksums[relPath] = checksum
+				reused++
+				return nil
+			}
+		}
+		hash, err := hashFile(filePath)
+		if err != nil {
+			return fmt.Errorf("can't hash %s: %s", filePath, err.Error())
+		}
+		checksums[relPath] = hex.EncodeToString(hash)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return checksums, reused, nil
+}
+
+// walkSnapshotFiles calls fn for each regular file of the snapshot, skipping the metadata files.
+func walkSnapshotFiles(snapshotPath string, fn func(filePath string, relPath string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(snapshotPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("can't read %s: %s", filePath, err.Error())
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(snapshotPath, filePath)
+		if err != nil {
+			return err
+		}
+		if isMetadataFile(relPath) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("can't stat %s: %s", filePath, err.Error())
+		}
+		return fn(filePath, relPath, info)
+	})
+}
+
+// readChecksums reads the checksums file of the snapshot at snapshotPath. The returned error satisfies
+// os.IsNotExist if the snapshot has no checksums.
+func readChecksums(snapshotPath string) (map[string]string, error) {
+	checksumsPath := path.Join(snapshotPath, ChecksumsFileName)
+	file, err := os.Open(checksumsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	checksums := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		// like sha256sum, a leading backslash means that the path is escaped
+		escaped := strings.HasPrefix(line, `\`)
+		checksum, relPath, ok := strings.Cut(strings.TrimPrefix(line, `\`), "  ")
+		if !ok || len(checksum) != 64 {
+			return nil, fmt.Errorf("%s:%d: invalid checksum line", checksumsPath, lineNumber)
+		}
+		if escaped {
+			relPath = unescapeChecksumPath(relPath)
+		}
+		checksums[relPath] = checksum
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read %s: %s", checksumsPath, err.Error())
+	}
+	return checksums, nil
+}
+
+// writeChecksums replaces the checksums file of the snapshot at snapshotPath, that could be a hard
+// link to the one of the previous snapshot.
+func writeChecksums(snapshotPath string, checksums map[string]string) error {
+	checksumsPath := path.Join(snapshotPath, ChecksumsFileName)
+	relPaths := make([]string, 0, len(checksums))
+	for relPath := range checksums {
+		relPaths = append(relPaths, relPath)
+	}
+	slices.Sort(relPaths)
+
+	file, err := os.CreateTemp(snapshotPath, ChecksumsFileName+".*")
+	if err != nil {
+		return fmt.Errorf("can't write checksums %s: %s", checksumsPath, err.Error())
+	}
+	writer := bufio.NewWriter(file)
+	for _, relPath := range relPaths {
+		if strings.ContainsAny(relPath, "\\\n") {
+			fmt.Fprintf(writer, "\\%s  %s\n", checksums[relPath], escapeChecksumPath(relPath))
+		} else {
+			fmt.Fprintf(writer, "%s  %s\n", checksums[relPath], relPath)
+		}
+	}
+	err = writer.Flush()
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), checksumsPath)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("can't write checksums %s: %s", checksumsPath, err.Error())
+	}
+	return nil
+}
+
+func escapeChecksumPath(relPath string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(relPath)
+}
+
+func unescapeChecksumPath(relPath string) string {
+	unescaped := strings.Builder{}
+	for i := 0; i < len(relPath); i++ {
+		if relPath[i] == '\\' && i+1 < len(relPath) {
+			i++
+			if relPath[i] == 'n' {
+				unescaped.WriteByte('\n')
+			} else {
+				unescaped.WriteByte(relPath[i])
+			}
+			continue
+		}
+		unescaped.WriteByte(relPath[i])
+	}
+	return unescaped.String()
+}
+
+// VerifySnapshot hashes again all the files of the snapshot and compares them with the checksums
+// computed when it was taken. Since the snapshots share the files through hard links, a mismatch
+// usually means that the same file is damaged in the other snapshots too.
+func VerifySnapshot(ctx context.Context, snapshotInfo *structs.SnapshotInfo) (*VerifyReport, error) {
+	checksums, err := readChecksums(snapshotInfo.Abspath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s has no checksums, set checksums in the snapshot config to compute them for the next snapshots", snapshotInfo.CompactName())
+	}
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{
+		Snapshot:   snapshotInfo.CompactName(),
+		Mismatched: []string{},
+		Missing:    []string{},
+		Extra:      []string{},
+		Unreadable: []string{},
+	}
+	found := map[string]bool{}
+	err = walkSnapshotFiles(snapshotInfo.Abspath, func(filePath string, relPath string, _ fs.FileInfo) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		checksum, ok := checksums[relPath]
+		if !ok {
+			report.Extra = append(report.Extra, relPath)
+			return nil
+		}
+		found[relPath] = true
+		hash, err := hashFile(filePath)
+		if err != nil {
+			report.Unreadable = append(report.Unreadable, fmt.Sprintf("%s: %s", relPath, err.Error()))
+			return nil
+		}
+		if hex.EncodeToString(hash) != checksum {
+			report.Mismatched = append(report.Mismatched, relPath)
+			return nil
+		}
+		report.Verified++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for relPath := range checksums {
+		if !found[relPath] {
+			report.Missing = append(report.Missing, relPath)
+		}
+	}
+	slices.Sort(report.Missing)
+	return report, nil
+}
@@ -0,0 +1,212 @@
+package snapshots
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"snapsync/structs"
+	"strings"
+	"testing"
+)
+
+// checksumsTestFiles have the paths that must be escaped in the checksums file.
+var checksumsTestFiles = map[string]string{
+	"a.txt":                  "a",
+	"dir/b.txt":              "b",
+	`dir/back\slash.txt`:     "backslash",
+	"new\nline.txt":          "newline",
+	`both\n` + "\n.txt":      "both",
+	structs.ManifestFileName: "{}",
+}
+
+func testChecksum(content string) string {
+	hash := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(hash[:])
+}
+
+// writeTestChecksums writes the files and their checksums in snapshotPath.
+func writeTestChecksums(t *testing.T, snapshotPath string, files map[string]string) map[string]string {
+	t.Helper()
+	writeTestTree(t, snapshotPath, files)
+	checksums, _, err := computeChecksums(context.Background(), snapshotPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeChecksums(snapshotPath, checksums); err != nil {
+		t.Fatal(err)
+	}
+	return checksums
+}
+
+func TestChecksumsRoundTrip(t *testing.T) {
+	snapshotPath := t.TempDir()
+	checksums := writeTestChecksums(t, snapshotPath, checksumsTestFiles)
+
+	want := map[string]string{}
+	for relPath, content := range checksumsTestFiles {
+		if relPath != structs.ManifestFileName {
+			want[relPath] = testChecksum(content)
+		}
+	}
+	if !maps.Equal(checksums, want) {
+		t.Errorf("computeChecksums returned %q, want %q", checksums, want)
+	}
+	read, err := readChecksums(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(read, want) {
+		t.Errorf("readChecksums returned %q, want %q", read, want)
+	}
+
+	content, err := os.ReadFile(path.Join(snapshotPath, ChecksumsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLines := []string{
+		testChecksum("a") + "  a.txt",
+		`\` + testChecksum("both") + `  both\\n\n.txt`,
+		testChecksum("b") + "  dir/b.txt",
+		`\` + testChecksum("backslash") + `  dir/back\\slash.txt`,
+		`\` + testChecksum("newline") + `  new\nline.txt`,
+	}
+	if lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n"); !slices.Equal(lines, wantLines) {
+		t.Errorf("the checksums file is\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(wantLines, "\n"))
+	}
+}
+
+func TestChecksumsSha256sumCompatible(t *testing.T) {
+	sha256sum, err := exec.LookPath("sha256sum")
+	if err != nil {
+		t.Skip("sha256sum is not installed")
+	}
+	snapshotPath := t.TempDir()
+	writeTestChecksums(t, snapshotPath, checksumsTestFiles)
+	command := exec.Command(sha256sum, "--check", "--strict", "--quiet", ChecksumsFileName)
+	command.Dir = snapshotPath
+	if output, err := command.CombinedOutput(); err != nil {
+		t.Errorf("sha256sum --check failed: %v\n%s", err, output)
+	}
+}
+
+func TestChecksumPathEscaping(t *testing.T) {
+	relPaths := []string{"plain", `a\b`, "a\nb", `a\nb`, `trailing\`, "\n", `\\`, `\` + "\n"}
+	for _, relPath := range relPaths {
+		if got := unescapeChecksumPath(escapeChecksumPath(relPath)); got != relPath {
+			t.Errorf("escaping and unescaping %q returned %q", relPath, got)
+		}
+	}
+}
+
+func TestReadChecksumsInvalid(t *testing.T) {
+	snapshotPath := t.TempDir()
+	writeTestTree(t, snapshotPath, map[string]string{ChecksumsFileName: testChecksum("a") + "  a.txt\nnot a checksum\n"})
+	_, err := readChecksums(snapshotPath)
+	if err == nil || !strings.Contains(err.Error(), ":2: invalid checksum line") {
+		t.Errorf("readChecksums returned %v, want an invalid line 2", err)
+	}
+	_, err = readChecksums(t.TempDir())
+	if !os.IsNotExist(err) {
+		t.Errorf("readChecksums without checksums returned %v, want a not exist error", err)
+	}
+}
+
+func TestVerifySnapshot(t *testing.T) {
+	snapshotPath := t.TempDir()
+	writeTestChecksums(t, snapshotPath, checksumsTestFiles)
+	snapshotInfo := &structs.SnapshotInfo{SnapshotName: "test", Abspath: snapshotPath}
+
+	report, err := VerifySnapshot(context.Background(), snapshotInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Verified != 5 {
+		t.Errorf("the untouched snapshot got the report %+v, want 5 verified files", report)
+	}
+
+	// a changed file with the same size and modification time, a deleted file and a new file
+	writeTestTree(t, snapshotPath, map[string]string{
+		`dir/back\slash.txt`: "BACKSLASH",
+		"extra.txt":          "extra",
+		// the metadata files are never checked
+		structs.ManifestFileName: "changed",
+	})
+	if err = os.Remove(path.Join(snapshotPath, "new\nline.txt")); err != nil {
+		t.Fatal(err)
+	}
+	report, err = VerifySnapshot(context.Background(), snapshotInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() {
+		t.Error("the damaged snapshot is OK")
+	}
+	if !slices.Equal(report.Mismatched, []string{`dir/back\slash.txt`}) {
+		t.Errorf("Mismatched = %q", report.Mismatched)
+	}
+	if !slices.Equal(report.Missing, []string{"new\nline.txt"}) {
+		t.Errorf("Missing = %q", report.Missing)
+	}
+	if !slices.Equal(report.Extra, []string{"extra.txt"}) {
+		t.Errorf("Extra = %q", report.Extra)
+	}
+	if report.Verified != 3 {
+		t.Errorf("Verified = %d, want 3", report.Verified)
+	}
+}
+
+func TestVerifySnapshotWithoutChecksums(t *testing.T) {
+	_, err := VerifySnapshot(context.Background(), &structs.SnapshotInfo{SnapshotName: "test", Abspath: t.TempDir()})
+	if err == nil || !strings.Contains(err.Error(), "test.0 has no checksums") {
+		t.Errorf("VerifySnapshot returned %v, want no checksums", err)
+	}
+}
+
+func TestComputeChecksumsReusesUnchangedFiles(t *testing.T) {
+	previousPath, snapshotPath := t.TempDir(), t.TempDir()
+	writeTestTree(t, previousPath, map[string]string{"same.txt": "same", "changed.txt": "old", "gone.txt": "gone"})
+	// a wrong checksum for same.txt tells if it was reused instead of hashing the file again
+	previousChecksums := map[string]string{
+		"same.txt":    strings.Repeat("0", 64),
+		"changed.txt": testChecksum("old"),
+		"gone.txt":    testChecksum("gone"),
+	}
+	if err := writeChecksums(previousPath, previousChecksums); err != nil {
+		t.Fatal(err)
+	}
+	// the snapshot is cloned from the previous one, then the sync rewrites changed.txt
+	if err := os.Link(path.Join(previousPath, "same.txt"), path.Join(snapshotPath, "same.txt")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTree(t, snapshotPath, map[string]string{"changed.txt": "new", "added.txt": "added"})
+
+	checksums, reused, err := computeChecksums(context.Background(), snapshotPath, previousPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"same.txt":    strings.Repeat("0", 64),
+		"changed.txt": testChecksum("new"),
+		"added.txt":   testChecksum("added"),
+	}
+	if !maps.Equal(checksums, want) {
+		t.Errorf("computeChecksums returned %q, want %q", checksums, want)
+	}
+	if reused != 1 {
+		t.Errorf("reused %d checksums, want 1", reused)
+	}
+
+	// a previous snapshot without checksums makes every file be hashed
+	checksums, reused, err = computeChecksums(context.Background(), snapshotPath, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused != 0 || checksums["same.txt"] != testChecksum("same") {
+		t.Errorf("computeChecksums without previous checksums reused %d checksums and returned %q", reused, checksums)
+	}
+}
@@ -0,0 +1,220 @@
+package snapshots
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"snapsync/structs"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// CloneError is a failure to clone a single entry of a snapshot tree.
+type CloneError struct {
+	Path string
+	Err  error
+}
+
+func (cloneError *CloneError) Error() string {
+	return fmt.Sprintf("%s: %s", cloneError.Path, cloneError.Err.Error())
+}
+
+// getCloneEngine returns the engine used to clone the latest snapshot. If the snapshot config doesn't
+// choose one, cp is used when cp_path is set, otherwise the native engine is used.
+func getCloneEngine(config *structs.Config, snapshotConfig *structs.SnapshotConfig) string {
+	if len(snapshotConfig.CloneEngine) > 0 {
+		return snapshotConfig.CloneEngine
+	}
+	if len(config.CpPath) > 0 {
+		return structs.CloneEngineCp
+	}
+	return structs.CloneEngineNative
+}
+
+// cloneSnapshot copies srcDir into dstDir using hard links for the files, using the engine chosen
+// by the snapshot config. The per file errors are only returned by the native engine.
+func cloneSnapshot(ctx context.Context, config *structs.Config, snapshotConfig *structs.SnapshotConfig, srcDir string, dstDir string) (cloneErrors []*CloneError, err error) {
+	switch engine := getCloneEngine(config, snapshotConfig); engine {
+	case structs.CloneEngineCp:
+		cpCommand := newCommand(ctx, config.CpPath, "-lra", "--", strings.TrimSuffix(srcDir, "/")+"/./", dstDir)
+		slog.Debug(fmt.Sprintf("running %s", cpCommand.String()))
+		cpOutput, err := cpCommand.CombinedOutput()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s, %s", cpCommand.String(), err.Error(), string(cpOutput))
+		}
+		return nil, nil
+	case structs.CloneEngineNative:
+		return CloneTree(ctx, srcDir, dstDir)
+	default:
+		return nil, fmt.Errorf("unknown clone engine %s", engine)
+	}
+}
+
+// CloneTree recreates the tree rooted at srcDir inside dstDir, that must already exist. Regular files
+// are hard linked, while directories, symlinks and special files are recreated with their mode,
+// ownership and times. Failures on single entries don't stop the cloning and are returned as
+// cloneErrors, while err is returned only if the tree can't be walked at all or ctx is done.
+func CloneTree(ctx context.Context, srcDir string, dstDir string) (cloneErrors []*CloneError, err error) {
+	rootInfo, err := os.Stat(srcDir)
+	if err != nil {
+		return nil, fmt.Errorf("can't stat %s: %s", srcDir, err.Error())
+	}
+	if !rootInfo.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", srcDir)
+	}
+
+	// the directories metadata are applied after their content is created, otherwise creating the
+	// entries would change the times and read only directories couldn't be filled
+	type dirToFix struct {
+		path string
+		info fs.FileInfo
+	}
+	dirsToFix := []dirToFix{}
+
+	err = filepath.WalkDir(srcDir, func(srcPath string, entry fs.DirEntry, walkErr error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if walkErr != nil {
+			if srcPath == srcDir {
+				return walkErr
+			}
+			cloneErrors = append(cloneErrors, &CloneError{Path: srcPath, Err: walkErr})
+			if entry != nil && entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relPath, err := filepath.Rel(srcDir, srcPath)
+		if err != nil {
+			return err
+		}
+		dstPath := path.Join(dstDir, relPath)
+		info, err := entry.Info()
+		if err != nil {
+			cloneErrors = append(cloneErrors, &CloneError{Path: srcPath, Err: err})
+			return nil
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if relPath != "." {
+				if err = os.Mkdir(dstPath, 0700); err != nil && !os.IsExist(err) {
+					cloneErrors = append(cloneErrors, &CloneError{Path: srcPath, Err: err})
+					return filepath.SkipDir
+				}
+			}
+			dirsToFix = append(dirsToFix, dirToFix{path: dstPath, info: info})
+		case mode.IsRegular():
+			if err = os.Link(srcPath, dstPath); err != nil {
+				cloneErrors = append(cloneErrors, &CloneError{Path: srcPath, Err: err})
+			}
+		case mode&fs.ModeSymlink != 0:
+			target, err := os.Readlink(srcPath)
+			if err == nil {
+				err = os.Symlink(target, dstPath)
+			}
+			if err == nil {
+				err = copyOwnership(dstPath, info)
+			}
+			if err == nil {
+				err = copySymlinkTimes(dstPath, info)
+			}
+			if err != nil {
+				cloneErrors = append(cloneErrors, &CloneError{Path: srcPath, Err: err})
+			}
+		default:
+			if err = cloneSpecialFile(dstPath, info); err != nil {
+				cloneErrors = append(cloneErrors, &CloneError{Path: srcPath, Err: err})
+			}
+		}
+		return nil
+	})
+	if ctx.Err() != nil {
+		return cloneErrors, ctx.Err()
+	}
+	if err != nil {
+		return cloneErrors, fmt.Errorf("can't walk %s: %s", srcDir, err.Error())
+	}
+
+	// fix the deepest directories first so that fixing a directory doesn't alter its parent times
+	for i := len(dirsToFix) - 1; i >= 0; i-- {
+		if err = copyMetadata(dirsToFix[i].path, dirsToFix[i].info); err != nil {
+			cloneErrors = append(cloneErrors, &CloneError{Path: dirsToFix[i].path, Err: err})
+		}
+	}
+	return cloneErrors, nil
+}
+
+// cloneSpecialFile recreates a device, fifo or socket with the same mode, ownership and times of info.
+func cloneSpecialFile(dstPath string, info fs.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("can't get the raw stat of %s", info.Name())
+	}
+	err := syscall.Mknod(dstPath, stat.Mode, int(stat.Rdev))
+	if err != nil {
+		return fmt.Errorf("can't create special file: %s", err.Error())
+	}
+	return copyMetadata(dstPath, info)
+}
+
+// copyOwnership sets the owner and group of info to dstPath, without following symlinks.
+func copyOwnership(dstPath string, info fs.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	err := os.Lchown(dstPath, int(stat.Uid), int(stat.Gid))
+	// only root can give files away, so when running unprivileged keep the current owner
+	if err != nil && !os.IsPermission(err) {
+		return fmt.Errorf("can't change ownership: %s", err.Error())
+	}
+	return nil
+}
+
+// copySymlinkTimes sets the times of info to the symlink at dstPath, instead of to its target.
+func copySymlinkTimes(dstPath string, info fs.FileInfo) error {
+	atime := unix.NsecToTimespec(info.ModTime().UnixNano())
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		atime = unix.Timespec{Sec: stat.Atim.Sec, Nsec: stat.Atim.Nsec}
+	}
+	times := []unix.Timespec{atime, unix.NsecToTimespec(info.ModTime().UnixNano())}
+	err := unix.UtimesNanoAt(unix.AT_FDCWD, dstPath, times, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return fmt.Errorf("can't change times: %s", err.Error())
+	}
+	return nil
+}
+
+// copyMetadata sets the ownership, mode and times of info to dstPath.
+func copyMetadata(dstPath string, info fs.FileInfo) error {
+	err := copyOwnership(dstPath, info)
+	if err != nil {
+		return err
+	}
+	// chmod after chown, since changing the owner clears the setuid and setgid bits
+	err = os.Chmod(dstPath, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky))
+	if err != nil {
+		return fmt.Errorf("can't change mode: %s", err.Error())
+	}
+	atime := info.ModTime()
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		atime = time.Unix(stat.Atim.Unix())
+	}
+	err = os.Chtimes(dstPath, atime, info.ModTime())
+	if err != nil {
+		return fmt.Errorf("can't change times: %s", err.Error())
+	}
+	return nil
+}
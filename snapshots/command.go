@@ -0,0 +1,24 @@
+package snapshots
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// commandStopTimeout is how long a command is given to exit after being stopped, before being killed.
+const commandStopTimeout = 10 * time.Second
+
+// newCommand returns a command that is stopped when ctx is done. The command runs in its own process
+// group, and the whole group is sent SIGTERM, so that the processes started by the hooks shells are
+// stopped too. If the command is still running after commandStopTimeout it's killed.
+func newCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	command := exec.CommandContext(ctx, name, args...)
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	command.Cancel = func() error {
+		return syscall.Kill(-command.Process.Pid, syscall.SIGTERM)
+	}
+	command.WaitDelay = commandStopTimeout
+	return command
+}
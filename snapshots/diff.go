@@ -0,0 +1,261 @@
+package snapshots
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"snapsync/structs"
+)
+
+const (
+	DiffAdded     = "added"
+	DiffRemoved   = "removed"
+	DiffModified  = "modified"
+	DiffUnchanged = "unchanged"
+)
+
+// DiffEntry is a path that differs between two snapshots, or that is unchanged.
+type DiffEntry struct {
+	// Path is relative to the root of the snapshots
+	Path   string `json:"path"`
+	Change string `json:"change"`
+	IsDir  bool   `json:"is_dir"`
+	// Reasons tell what was modified: size, mtime, mode, content or target for the symlinks
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+type DiffSummary struct {
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Modified  int `json:"modified"`
+	Unchanged int `json:"unchanged"`
+}
+
+type Diff struct {
+	From    string       `json:"from"`
+	To      string       `json:"to"`
+	Summary DiffSummary  `json:"summary"`
+	Entries []*DiffEntry `json:"entries"`
+}
+
+type DiffOptions struct {
+	// Content compares also the SHA-256 checksums of the content of the regular files of the same
+	// size, so that a change that kept the size and the modification time is found
+	Content bool
+	// Unchanged adds the unchanged paths to the entries, that are only counted otherwise
+	Unchanged bool
+	// Ownership compares also the owner and the group, when running as root like the sync does
+	Ownership bool
+}
+
+type snapshotsDiff struct {
+	options *DiffOptions
+	diff    *Diff
+	// skipMetadataFiles ignores the metadata files in the root of the trees, that are snapshots
+	skipMetadataFiles bool
+}
+
+// DiffSnapshots compares the snapshot from with the snapshot to. The files that are the same inode in
+// both snapshots, since the sync didn't touch them, are unchanged without looking any further.
+func DiffSnapshots(from *structs.SnapshotInfo, to *structs.SnapshotInfo, options *DiffOptions) (*Diff, error) {
+	state := &snapshotsDiff{
+		options:           options,
+		diff:              &Diff{From: from.CompactName(), To: to.CompactName(), Entries: []*DiffEntry{}},
+		skipMetadataFiles: true,
+	}
+	err := state.diffDir(from.Abspath, to.Abspath, "")
+	if err != nil {
+		return nil, err
+	}
+	return state.diff, nil
+}
+
+// diffTrees compares the tree at fromDir with the tree at toDir, that can be any directories. If
+// fromDir doesn't exist everything in toDir is added. The ownership is compared too, as the sync
+// copies it.
+func diffTrees(fromDir string, toDir string, skipMetadataFiles bool) (*Diff, error) {
+	state := &snapshotsDiff{
+		options:           &DiffOptions{Ownership: true},
+		diff:              &Diff{From: fromDir, To: toDir, Entries: []*DiffEntry{}},
+		skipMetadataFiles: skipMetadataFiles,
+	}
+	if _, err := os.Lstat(fromDir); os.IsNotExist(err) {
+		toEntries, err := os.ReadDir(toDir)
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %s", toDir, err.Error())
+		}
+		if skipMetadataFiles {
+			toEntries = withoutMetadataFiles(toEntries)
+		}
+		for _, entry := range toEntries {
+			err = state.addTree(path.Join(toDir, entry.Name()), entry.Name(), DiffAdded)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return state.diff, nil
+	}
+	err := state.diffDir(fromDir, toDir, "")
+	if err != nil {
+		return nil, err
+	}
+	return state.diff, nil
+}
+
+func (state *snapshotsDiff) add(entry *DiffEntry) {
+	switch entry.Change {
+	case DiffAdded:
+		state.diff.Summary.Added++
+	case DiffRemoved:
+		state.diff.Summary.Removed++
+	case DiffModified:
+		state.diff.Summary.Modified++
+	case DiffUnchanged:
+		state.diff.Summary.Unchanged++
+		if !state.options.Unchanged {
+			return
+		}
+	}
+	state.diff.Entries = append(state.diff.Entries, entry)
+}
+
+// diffDir compares the content of fromDir and toDir, visiting the entries sorted by name.
+func (state *snapshotsDiff) diffDir(fromDir string, toDir string, relDir string) error {
+	fromEntries, err := os.ReadDir(fromDir)
+	if err != nil {
+		return fmt.Errorf("can't read %s: %s", fromDir, err.Error())
+	}
+	toEntries, err := os.ReadDir(toDir)
+	if err != nil {
+		return fmt.Errorf("can't read %s: %s", toDir, err.Error())
+	}
+	// the metadata files differ in every snapshot, but they are not snapshotted files
+	if len(relDir) == 0 && state.skipMetadataFiles {
+		fromEntries = withoutMetadataFiles(fromEntries)
+		toEntries = withoutMetadataFiles(toEntries)
+	}
+	i, j := 0, 0
+	for i < len(fromEntries) || j < len(toEntries) {
+		switch {
+		case j >= len(toEntries) || (i < len(fromEntries) && fromEntries[i].Name() < toEntries[j].Name()):
+			err = state.addTree(path.Join(fromDir, fromEntries[i].Name()), path.Join(relDir, fromEntries[i].Name()), DiffRemoved)
+			i++
+		case i >= len(fromEntries) || toEntries[j].Name() < fromEntries[i].Name():
+			err = state.addTree(path.Join(toDir, toEntries[j].Name()), path.Join(relDir, toEntries[j].Name()), DiffAdded)
+			j++
+		default:
+			name := fromEntries[i].Name()
+			err = state.diffEntry(path.Join(fromDir, name), path.Join(toDir, name), path.Join(relDir, name))
+			i++
+			j++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func withoutMetadataFiles(entries []fs.DirEntry) []fs.DirEntry {
+	return slices.DeleteFunc(entries, func(entry fs.DirEntry) bool {
+		return isMetadataFile(entry.Name())
+	})
+}
+
+// diffEntry compares two entries with the same path.
+func (state *snapshotsDiff) diffEntry(fromPath string, toPath string, relPath string) error {
+	fromInfo, err := os.Lstat(fromPath)
+	if err != nil {
+		return fmt.Errorf("can't stat %s: %s", fromPath, err.Error())
+	}
+	toInfo, err := os.Lstat(toPath)
+	if err != nil {
+		return fmt.Errorf("can't stat %s: %s", toPath, err.Error())
+	}
+	// an entry that changed type is a different entry
+	if fromInfo.Mode().Type() != toInfo.Mode().Type() {
+		err = state.addTree(fromPath, relPath, DiffRemoved)
+		if err != nil {
+			return err
+		}
+		return state.addTree(toPath, relPath, DiffAdded)
+	}
+	if fromInfo.IsDir() {
+		reasons := []string{}
+		if fromInfo.Mode() != toInfo.Mode() {
+			reasons = append(reasons, "mode")
+		}
+		if state.options.Ownership && !sameOwnership(fromInfo, toInfo) {
+			reasons = append(reasons, "owner")
+		}
+		if len(reasons) > 0 {
+			state.add(&DiffEntry{Path: relPath, Change: DiffModified, IsDir: true, Reasons: reasons})
+		}
+		return state.diffDir(fromPath, toPath, relPath)
+	}
+	// the same inode is the same file, since the sync replaces the changed files with new ones
+	if getFileID(fromInfo) == getFileID(toInfo) {
+		state.add(&DiffEntry{Path: relPath, Change: DiffUnchanged})
+		return nil
+	}
+
+	reasons := []string{}
+	if fromInfo.Size() != toInfo.Size() {
+		reasons = append(reasons, "size")
+	}
+	if !fromInfo.ModTime().Equal(toInfo.ModTime()) {
+		reasons = append(reasons, "mtime")
+	}
+	if fromInfo.Mode() != toInfo.Mode() {
+		reasons = append(reasons, "mode")
+	}
+	if state.options.Ownership && !sameOwnership(fromInfo, toInfo) {
+		reasons = append(reasons, "owner")
+	}
+	switch {
+	case fromInfo.Mode()&fs.ModeSymlink != 0:
+		fromTarget, err := os.Readlink(fromPath)
+		if err != nil {
+			return fmt.Errorf("can't read link %s: %s", fromPath, err.Error())
+		}
+		toTarget, err := os.Readlink(toPath)
+		if err != nil {
+			return fmt.Errorf("can't read link %s: %s", toPath, err.Error())
+		}
+		if fromTarget != toTarget {
+			reasons = append(reasons, "target")
+		}
+	case fromInfo.Mode().IsRegular() && state.options.Content && fromInfo.Size() == toInfo.Size():
+		same, err := sameContent(fromPath, toPath)
+		if err != nil {
+			return err
+		}
+		if !same {
+			reasons = append(reasons, "content")
+		}
+	}
+	if len(reasons) == 0 {
+		state.add(&DiffEntry{Path: relPath, Change: DiffUnchanged})
+		return nil
+	}
+	state.add(&DiffEntry{Path: relPath, Change: DiffModified, Reasons: reasons})
+	return nil
+}
+
+// addTree adds root and everything inside it with the same change.
+func (state *snapshotsDiff) addTree(root string, relRoot string, change string) error {
+	return filepath.WalkDir(root, func(entryPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("can't read %s: %s", entryPath, err.Error())
+		}
+		relPath, err := filepath.Rel(root, entryPath)
+		if err != nil {
+			return err
+		}
+		state.add(&DiffEntry{Path: path.Join(relRoot, relPath), Change: change, IsDir: entry.IsDir()})
+		return nil
+	})
+}
@@ -0,0 +1,202 @@
+package snapshots
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// pathPattern is an rsync style pattern: a pattern starting with / is anchored to the root of the
+// transfer, a pattern ending with / matches only directories, a pattern containing a / is matched
+// against the end of the relative path, otherwise it's matched against the name of the entry.
+// * matches anything but /, ** matches anything and ? matches a single character but /.
+type pathPattern struct {
+	regex    *regexp.Regexp
+	anchored bool
+	dirOnly  bool
+	fullPath bool
+}
+
+func compilePathPattern(pattern string) (*pathPattern, error) {
+	compiled := &pathPattern{}
+	if strings.HasSuffix(pattern, "/") {
+		compiled.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if strings.HasPrefix(pattern, "/") {
+		compiled.anchored = true
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+	if len(pattern) == 0 {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	compiled.fullPath = compiled.anchored || strings.Contains(pattern, "/") || strings.Contains(pattern, "**")
+
+	regexString := "^"
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				regexString += ".*"
+				i++
+			} else {
+				regexString += "[^/]*"
+			}
+		case '?':
+			regexString += "[^/]"
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				regexString += regexp.QuoteMeta(string(c))
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			regexString += "[" + strings.ReplaceAll(class, `\`, `\\`) + "]"
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				regexString += regexp.QuoteMeta(string(pattern[i+1]))
+				i++
+			}
+		default:
+			regexString += regexp.QuoteMeta(string(c))
+		}
+	}
+	regexString += "$"
+	regex, err := regexp.Compile(regexString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %s", pattern, err.Error())
+	}
+	compiled.regex = regex
+	return compiled, nil
+}
+
+// matches tells if relPath, relative to the root of the transfer and separated by /, matches the pattern.
+func (pattern *pathPattern) matches(relPath string, isDir bool) bool {
+	if pattern.dirOnly && !isDir {
+		return false
+	}
+	if pattern.anchored {
+		return pattern.regex.MatchString(relPath)
+	}
+	if !pattern.fullPath {
+		return pattern.regex.MatchString(relPath[strings.LastIndexByte(relPath, '/')+1:])
+	}
+	// try every trailing portion of the path that starts after a /
+	for candidate := relPath; ; {
+		if pattern.regex.MatchString(candidate) {
+			return true
+		}
+		slash := strings.IndexByte(candidate, '/')
+		if slash < 0 {
+			return false
+		}
+		candidate = candidate[slash+1:]
+	}
+}
+
+type filterRule struct {
+	pattern *pathPattern
+	include bool
+}
+
+// pathFilter tells which paths are excluded from a sync. Like rsync, the rules are checked in order
+// and the first matching rule wins.
+type pathFilter struct {
+	rules []filterRule
+}
+
+func newPathFilter(options *SyncOptions) (*pathFilter, error) {
+	filter := &pathFilter{}
+	for _, rule := range options.Filters {
+		include, pattern, err := parseFilterRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		if err = filter.addRule(pattern, include); err != nil {
+			return nil, fmt.Errorf("invalid filter %s: %s", rule, err.Error())
+		}
+	}
+	for _, include := range options.Includes {
+		if err := filter.addRule(include, true); err != nil {
+			return nil, fmt.Errorf("invalid include %s: %s", include, err.Error())
+		}
+	}
+	for _, exclude := range options.Excludes {
+		if err := filter.addRule(exclude, false); err != nil {
+			return nil, fmt.Errorf("invalid exclude %s: %s", exclude, err.Error())
+		}
+	}
+	for _, excludeFrom := range options.ExcludeFrom {
+		excludes, err := readPatternsFile(excludeFrom)
+		if err != nil {
+			return nil, err
+		}
+		for _, exclude := range excludes {
+			if err = filter.addRule(exclude, false); err != nil {
+				return nil, fmt.Errorf("invalid exclude %s in %s: %s", exclude, excludeFrom, err.Error())
+			}
+		}
+	}
+	return filter, nil
+}
+
+func (filter *pathFilter) addRule(pattern string, include bool) error {
+	compiled, err := compilePathPattern(pattern)
+	if err != nil {
+		return err
+	}
+	filter.rules = append(filter.rules, filterRule{pattern: compiled, include: include})
+	return nil
+}
+
+func (filter *pathFilter) isExcluded(relPath string, isDir bool) bool {
+	for _, rule := range filter.rules {
+		if rule.pattern.matches(relPath, isDir) {
+			return !rule.include
+		}
+	}
+	return false
+}
+
+// parseFilterRule parses the include and exclude rsync filter rules, like "- *.log" or
+// "include /docs/". The other kinds of rules are supported only by rsync.
+func parseFilterRule(rule string) (include bool, pattern string, err error) {
+	kind, pattern, found := strings.Cut(rule, " ")
+	if !found {
+		kind, pattern, found = strings.Cut(rule, "_")
+	}
+	if !found || len(pattern) == 0 {
+		return false, "", fmt.Errorf("invalid filter %s", rule)
+	}
+	switch kind {
+	case "+", "include":
+		return true, pattern, nil
+	case "-", "exclude":
+		return false, pattern, nil
+	default:
+		return false, "", fmt.Errorf("filter %s is supported only by rsync", rule)
+	}
+}
+
+// readPatternsFile reads a file with a pattern per line, skipping the empty lines and the comments
+// starting with ; or #, like rsync --exclude-from does.
+func readPatternsFile(filePath string) ([]string, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %s", filePath, err.Error())
+	}
+	patterns := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) == 0 || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
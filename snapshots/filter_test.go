@@ -0,0 +1,120 @@
+package snapshots
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPathPatternMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		relPath string
+		isDir   bool
+		want    bool
+	}{
+		// unanchored patterns without a slash match the name at any depth
+		{"*.log", "app.log", false, true},
+		{"*.log", "var/log/app.log", false, true},
+		{"*.log", "app.log.1", false, false},
+		{"cache", "home/user/cache", true, true},
+		{"cache", "home/user/cache/file", false, false},
+		// anchored patterns match from the root of the transfer only
+		{"/cache", "cache", true, true},
+		{"/cache", "home/cache", true, false},
+		{"/home/*.txt", "home/a.txt", false, true},
+		{"/home/*.txt", "home/user/a.txt", false, false},
+		// unanchored patterns with a slash match the end of the path
+		{"user/cache", "home/user/cache", true, true},
+		{"user/cache", "home/otheruser/cache", true, false},
+		// * doesn't cross a slash, ** does
+		{"/home/*", "home/user/a.txt", false, false},
+		{"/home/**", "home/user/a.txt", false, true},
+		{"**/node_modules", "a/b/c/node_modules", true, true},
+		{"/src/**/*.o", "src/a/b/main.o", false, true},
+		{"/src/**/*.o", "lib/a/main.o", false, false},
+		// ? matches a single character but a slash
+		{"file?.txt", "file1.txt", false, true},
+		{"file?.txt", "file10.txt", false, false},
+		{"a?b", "a/b", false, false},
+		// character classes, negated with !
+		{"file[0-9].txt", "file5.txt", false, true},
+		{"file[!0-9].txt", "file5.txt", false, false},
+		{"file[!0-9].txt", "filex.txt", false, true},
+		// a trailing slash matches only directories
+		{"tmp/", "tmp", true, true},
+		{"tmp/", "tmp", false, false},
+		// escaped wildcards match themselves
+		{`a\*b`, "a*b", false, true},
+		{`a\*b`, "axb", false, false},
+	}
+	for _, test := range tests {
+		pattern, err := compilePathPattern(test.pattern)
+		if err != nil {
+			t.Fatalf("compilePathPattern(%q): %s", test.pattern, err.Error())
+		}
+		if got := pattern.matches(test.relPath, test.isDir); got != test.want {
+			t.Errorf("pattern %q matches(%q, dir=%t) = %t, want %t", test.pattern, test.relPath, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestCompilePathPatternEmpty(t *testing.T) {
+	for _, pattern := range []string{"", "/", "//"} {
+		if _, err := compilePathPattern(pattern); err == nil {
+			t.Errorf("compilePathPattern(%q) succeeded, want an error", pattern)
+		}
+	}
+}
+
+func TestPathFilterPrecedence(t *testing.T) {
+	excludeFrom := path.Join(t.TempDir(), "excludes")
+	err := os.WriteFile(excludeFrom, []byte("# comment\n; comment\n\n*.bak\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		options *SyncOptions
+		relPath string
+		isDir   bool
+		want    bool
+	}{
+		{"no rules", &SyncOptions{}, "a.log", false, false},
+		{"exclude", &SyncOptions{Excludes: []string{"*.log"}}, "a.log", false, true},
+		{"include before exclude", &SyncOptions{Includes: []string{"keep.log"}, Excludes: []string{"*.log"}}, "keep.log", false, false},
+		{"include doesn't exclude the rest", &SyncOptions{Includes: []string{"keep.log"}, Excludes: []string{"*.log"}}, "other.log", false, true},
+		{"filters before includes", &SyncOptions{Filters: []string{"- keep.log"}, Includes: []string{"keep.log"}}, "keep.log", false, true},
+		{"filters before excludes", &SyncOptions{Filters: []string{"+ keep.log"}, Excludes: []string{"*"}}, "keep.log", false, false},
+		{"first matching filter wins", &SyncOptions{Filters: []string{"include a.log", "exclude *.log"}}, "a.log", false, false},
+		{"long filter names", &SyncOptions{Filters: []string{"exclude *.log"}}, "a.log", false, true},
+		{"underscore filter", &SyncOptions{Filters: []string{"-_*.log"}}, "a.log", false, true},
+		{"exclude from", &SyncOptions{ExcludeFrom: []string{excludeFrom}}, "dir/a.bak", false, true},
+		{"exclude from comments", &SyncOptions{ExcludeFrom: []string{excludeFrom}}, "# comment", false, false},
+		{"directory only exclude on file", &SyncOptions{Excludes: []string{"build/"}}, "build", false, false},
+		{"directory only exclude on dir", &SyncOptions{Excludes: []string{"build/"}}, "build", true, true},
+	}
+	for _, test := range tests {
+		filter, err := newPathFilter(test.options)
+		if err != nil {
+			t.Fatalf("%s: newPathFilter: %s", test.name, err.Error())
+		}
+		if got := filter.isExcluded(test.relPath, test.isDir); got != test.want {
+			t.Errorf("%s: isExcluded(%q) = %t, want %t", test.name, test.relPath, got, test.want)
+		}
+	}
+}
+
+func TestNewPathFilterInvalid(t *testing.T) {
+	tests := []*SyncOptions{
+		{Filters: []string{"merge .rsync-filter"}},
+		{Filters: []string{"+"}},
+		{Excludes: []string{""}},
+		{ExcludeFrom: []string{path.Join(t.TempDir(), "missing")}},
+	}
+	for _, options := range tests {
+		if _, err := newPathFilter(options); err == nil {
+			t.Errorf("newPathFilter(%+v) succeeded, want an error", options)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package snapshots
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"snapsync/structs"
+	"time"
+)
+
+const (
+	// JournalPhaseSyncing means that the tmp dir is being filled, so an interrupted run is rolled back
+	JournalPhaseSyncing = "syncing"
+	// JournalPhaseCommitting means that the tmp dir is complete and the snapshots are being renamed, so
+	// an interrupted run is rolled forward
+	JournalPhaseCommitting = "committing"
+)
+
+// Journal describes the steps of a snapshot run, so that a run interrupted before completing them can
+// be repaired by RecoverSnapshots.
+type Journal struct {
+	SnapshotName string    `json:"snapshot_name"`
+	Phase        string    `json:"phase"`
+	Pid          int       `json:"pid"`
+	StartedAt    time.Time `json:"started_at"`
+	TmpDir       string    `json:"tmp_dir"`
+	// SnapshotPath is the path the tmp dir is renamed to when committing
+	SnapshotPath string `json:"snapshot_path,omitempty"`
+	// Rotations are the numbers of the snapshots with index naming to rename to number+1 before
+	// committing, from the highest
+	Rotations []int `json:"rotations,omitempty"`
+	// UpdateLatestLink tells to point the latest symlink to SnapshotPath after committing
+	UpdateLatestLink bool `json:"update_latest_link,omitempty"`
+}
+
+// RecoveryReport lists what was done, or would be done with a dry run, to repair the snapshots.
+type RecoveryReport struct {
+	SnapshotName string
+	Actions      []string
+}
+
+func GetJournalPath(snapshotConfig *structs.SnapshotConfig) string {
+	return path.Join(snapshotConfig.SnapshotsDir, fmt.Sprintf(".%s.journal.json", snapshotConfig.SnapshotName))
+}
+
+func getTmpDirPattern(snapshotConfig *structs.SnapshotConfig) string {
+	return fmt.Sprintf("tmp-%s-", snapshotConfig.SnapshotName)
+}
+
+// writeJournal atomically replaces the journal of snapshotConfig.
+func writeJournal(snapshotConfig *structs.SnapshotConfig, journal *Journal) error {
+	journalPath := GetJournalPath(snapshotConfig)
+	content, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't encode journal: %s", err.Error())
+	}
+	tmpJournalPath := journalPath + ".tmp"
+	file, err := os.OpenFile(tmpJournalPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("can't write journal %s: %s", tmpJournalPath, err.Error())
+	}
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpJournalPath, journalPath)
+	}
+	if err != nil {
+		os.Remove(tmpJournalPath)
+		return fmt.Errorf("can't write journal %s: %s", journalPath, err.Error())
+	}
+	return nil
+}
+
+func readJournal(snapshotConfig *structs.SnapshotConfig) (*Journal, error) {
+	content, err := os.ReadFile(GetJournalPath(snapshotConfig))
+	if err != nil {
+		return nil, err
+	}
+	journal := &Journal{}
+	err = json.Unmarshal(content, journal)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse journal %s: %s", GetJournalPath(snapshotConfig), err.Error())
+	}
+	return journal, nil
+}
+
+func removeJournal(snapshotConfig *structs.SnapshotConfig) error {
+	err := os.Remove(GetJournalPath(snapshotConfig))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("can't remove journal: %s", err.Error())
+	}
+	return nil
+}
+
+// planCommit fills the journal with the renames needed to commit the tmp dir as the newest snapshot.
+func planCommit(snapshotConfig *structs.SnapshotConfig, journal *Journal, snapshotTime time.Time) error {
+	if isTimestampNaming(snapshotConfig) {
+		journal.SnapshotPath = path.Join(snapshotConfig.SnapshotsDir, GetSnapshotTimestampDirName(snapshotConfig.SnapshotName, snapshotTime))
+		if _, err := os.Lstat(journal.SnapshotPath); err == nil {
+			return fmt.Errorf("snapshot %s already exists", journal.SnapshotPath)
+		}
+		journal.UpdateLatestLink = true
+		return nil
+	}
+	snapshotsInfo, err := ListSnapshots(snapshotConfig)
+	if err != nil {
+		return err
+	}
+	journal.Rotations = []int{}
+	// the list is sorted from the newest, so the renaming starts from the oldest
+	for i := len(snapshotsInfo) - 1; i >= 0; i-- {
+		if !snapshotsInfo[i].Timestamped {
+			journal.Rotations = append(journal.Rotations, snapshotsInfo[i].Number)
+		}
+	}
+	journal.SnapshotPath = path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName(snapshotConfig.SnapshotName, 0))
+	return nil
+}
+
+// applyCommit executes the renames planned in the journal. It can be run again after being
+// interrupted: a snapshot is renamed only if it still exists and its new name is free, that is
+// true only for the renames that didn't happen yet, since they go from the highest number.
+func applyCommit(snapshotConfig *structs.SnapshotConfig, journal *Journal) error {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	for _, number := range journal.Rotations {
+		snapshotOldPath := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName(snapshotConfig.SnapshotName, number))
+		snapshotRenamedPath := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName(snapshotConfig.SnapshotName, number+1))
+		if _, err := os.Lstat(snapshotOldPath); err != nil {
+			continue
+		}
+		if _, err := os.Lstat(snapshotRenamedPath); err == nil {
+			continue
+		}
+		slog.Debug(fmt.Sprintf("%s renaming %s to %s", snapshotLogPrefix, snapshotOldPath, path.Base(snapshotRenamedPath)))
+		err := os.Rename(snapshotOldPath, snapshotRenamedPath)
+		if err != nil {
+			return fmt.Errorf("%s can't move %s to %s: %s", snapshotLogPrefix, snapshotOldPath, snapshotRenamedPath, err.Error())
+		}
+	}
+
+	// rename the temporary folder to be the newest snapshot
+	if _, err := os.Lstat(journal.TmpDir); err == nil {
+		if _, err = os.Lstat(journal.SnapshotPath); err == nil {
+			return fmt.Errorf("%s can't rename temp directory %s to %s: it already exists", snapshotLogPrefix, journal.TmpDir, journal.SnapshotPath)
+		}
+		slog.Debug(fmt.Sprintf("%s renaming tmp dir %s to %s", snapshotLogPrefix, journal.TmpDir, journal.SnapshotPath))
+		err = os.Rename(journal.TmpDir, journal.SnapshotPath)
+		if err != nil {
+			return fmt.Errorf("%s can't rename temp directory %s to %s: %s", snapshotLogPrefix, journal.TmpDir, journal.SnapshotPath, err.Error())
+		}
+	} else if _, err = os.Lstat(journal.SnapshotPath); err != nil {
+		return fmt.Errorf("%s neither the temp directory %s nor the snapshot %s exist", snapshotLogPrefix, journal.TmpDir, journal.SnapshotPath)
+	}
+
+	if journal.UpdateLatestLink {
+		err := updateLatestLink(snapshotConfig, journal.SnapshotPath)
+		if err != nil {
+			return fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+		}
+	}
+	return nil
+}
+
+// RecoverSnapshots repairs the snapshots of snapshotConfig left inconsistent by an interrupted run:
+// a run interrupted while syncing is rolled back deleting its tmp dir, while a run interrupted while
+// renaming the snapshots is rolled forward. The orphaned tmp dirs are deleted too. With dryRun the
+// actions are only reported. If a run is in progress nothing is repaired and the returned error wraps
+// ErrLockHeld.
+func RecoverSnapshots(snapshotConfig *structs.SnapshotConfig, dryRun bool) (*RecoveryReport, error) {
+	lock, err := AcquireLock(context.Background(), snapshotConfig, "recovery", structs.LockPolicySkip, 0)
+	if err != nil {
+		return &RecoveryReport{SnapshotName: snapshotConfig.SnapshotName}, fmt.Errorf("[%s] %w", snapshotConfig.SnapshotName, err)
+	}
+	defer lock.Release()
+	return recoverSnapshots(snapshotConfig, dryRun)
+}
+
+// recoverSnapshots is RecoverSnapshots for the callers already holding the lock, so that no run can
+// be in progress and every journal belongs to an interrupted run.
+func recoverSnapshots(snapshotConfig *structs.SnapshotConfig, dryRun bool) (*RecoveryReport, error) {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	report := &RecoveryReport{SnapshotName: snapshotConfig.SnapshotName}
+	apply := func(action string, fn func() error) error {
+		report.Actions = append(report.Actions, action)
+		if dryRun {
+			return nil
+		}
+		slog.Info(fmt.Sprintf("%s %s", snapshotLogPrefix, action))
+		return fn()
+	}
+
+	journal, err := readJournal(snapshotConfig)
+	if err != nil && !os.IsNotExist(err) {
+		return report, fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	if journal != nil {
+		switch journal.Phase {
+		case JournalPhaseCommitting:
+			err = apply(fmt.Sprintf("rolling forward the run started at %s committing %s", journal.StartedAt.Format(time.RFC3339), journal.SnapshotPath), func() error {
+				return applyCommit(snapshotConfig, journal)
+			})
+		default:
+			err = apply(fmt.Sprintf("rolling back the run started at %s deleting %s", journal.StartedAt.Format(time.RFC3339), journal.TmpDir), func() error {
+				return os.RemoveAll(journal.TmpDir)
+			})
+		}
+		if err != nil {
+			return report, err
+		}
+		err = apply("removing journal "+GetJournalPath(snapshotConfig), func() error {
+			return removeJournal(snapshotConfig)
+		})
+		if err != nil {
+			return report, fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+		}
+	}
+
+	entries, err := os.ReadDir(snapshotConfig.SnapshotsDir)
+	if os.IsNotExist(err) {
+		return report, nil
+	}
+	if err != nil {
+		return report, fmt.Errorf("%s can't read directory %s: %s", snapshotLogPrefix, snapshotConfig.SnapshotsDir, err.Error())
+	}
+	// tmp<digits> are the tmp dirs created before they were named after the snapshot
+	orphanRegex := regexp.MustCompile(fmt.Sprintf(`^(tmp[0-9]+|%s[0-9]+)$`, regexp.QuoteMeta(getTmpDirPattern(snapshotConfig))))
+	for _, entry := range entries {
+		if !entry.IsDir() || !orphanRegex.MatchString(entry.Name()) {
+			continue
+		}
+		orphanPath := path.Join(snapshotConfig.SnapshotsDir, entry.Name())
+		// the tmp dir of the journal was already rolled back or forward
+		if journal != nil && orphanPath == journal.TmpDir {
+			continue
+		}
+		err = apply("deleting orphaned tmp dir "+orphanPath, func() error {
+			return os.RemoveAll(orphanPath)
+		})
+		if err != nil {
+			return report, fmt.Errorf("%s can't delete %s: %s", snapshotLogPrefix, orphanPath, err.Error())
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,268 @@
+package snapshots
+
+import (
+	"maps"
+	"os"
+	"path"
+	"snapsync/structs"
+	"testing"
+	"time"
+)
+
+var testJournalTime = time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+func journalTestConfig(t *testing.T, naming string) *structs.SnapshotConfig {
+	t.Helper()
+	return &structs.SnapshotConfig{SnapshotName: "test", SnapshotsDir: t.TempDir(), Naming: naming}
+}
+
+// writeTestJournal writes a journal of snapshotConfig in phase, committing tmpDirName as snapshotDirName.
+func writeTestJournal(t *testing.T, snapshotConfig *structs.SnapshotConfig, phase string, tmpDirName string, snapshotDirName string, rotations []int) *Journal {
+	t.Helper()
+	journal := &Journal{
+		SnapshotName: snapshotConfig.SnapshotName,
+		Phase:        phase,
+		Pid:          1,
+		StartedAt:    testJournalTime,
+		TmpDir:       path.Join(snapshotConfig.SnapshotsDir, tmpDirName),
+		SnapshotPath: path.Join(snapshotConfig.SnapshotsDir, snapshotDirName),
+		Rotations:    rotations,
+	}
+	if err := writeJournal(snapshotConfig, journal); err != nil {
+		t.Fatal(err)
+	}
+	return journal
+}
+
+func TestRecoverSnapshotsIndexNaming(t *testing.T) {
+	tests := []struct {
+		name      string
+		phase     string
+		rotations []int
+		before    map[string]string
+		after     map[string]string
+	}{
+		{
+			name:  "interrupted while syncing",
+			phase: JournalPhaseSyncing,
+			before: map[string]string{
+				"tmp-test-1/a.txt": "new",
+				"test.0/a.txt":     "0",
+			},
+			after: map[string]string{
+				"test.0/":      "",
+				"test.0/a.txt": "0",
+			},
+		},
+		{
+			name:  "interrupted while syncing before creating the tmp dir",
+			phase: JournalPhaseSyncing,
+			before: map[string]string{
+				"test.0/a.txt": "0",
+			},
+			after: map[string]string{
+				"test.0/":      "",
+				"test.0/a.txt": "0",
+			},
+		},
+		{
+			name:      "interrupted before renaming",
+			phase:     JournalPhaseCommitting,
+			rotations: []int{1, 0},
+			before: map[string]string{
+				"tmp-test-1/a.txt": "new",
+				"test.0/a.txt":     "0",
+				"test.1/a.txt":     "1",
+			},
+			after: map[string]string{
+				"test.0/":      "",
+				"test.0/a.txt": "new",
+				"test.1/":      "",
+				"test.1/a.txt": "0",
+				"test.2/":      "",
+				"test.2/a.txt": "1",
+			},
+		},
+		{
+			name:      "interrupted between two renames",
+			phase:     JournalPhaseCommitting,
+			rotations: []int{1, 0},
+			before: map[string]string{
+				"tmp-test-1/a.txt": "new",
+				"test.0/a.txt":     "0",
+				"test.2/a.txt":     "1",
+			},
+			after: map[string]string{
+				"test.0/":      "",
+				"test.0/a.txt": "new",
+				"test.1/":      "",
+				"test.1/a.txt": "0",
+				"test.2/":      "",
+				"test.2/a.txt": "1",
+			},
+		},
+		{
+			name:      "interrupted after renaming the tmp dir",
+			phase:     JournalPhaseCommitting,
+			rotations: []int{1, 0},
+			before: map[string]string{
+				"test.0/a.txt": "new",
+				"test.1/a.txt": "0",
+				"test.2/a.txt": "1",
+			},
+			after: map[string]string{
+				"test.0/":      "",
+				"test.0/a.txt": "new",
+				"test.1/":      "",
+				"test.1/a.txt": "0",
+				"test.2/":      "",
+				"test.2/a.txt": "1",
+			},
+		},
+		{
+			name:      "rotations with a gap",
+			phase:     JournalPhaseCommitting,
+			rotations: []int{3, 0},
+			before: map[string]string{
+				"tmp-test-1/a.txt": "new",
+				"test.0/a.txt":     "0",
+				"test.3/a.txt":     "3",
+			},
+			after: map[string]string{
+				"test.0/":      "",
+				"test.0/a.txt": "new",
+				"test.1/":      "",
+				"test.1/a.txt": "0",
+				"test.4/":      "",
+				"test.4/a.txt": "3",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snapshotConfig := journalTestConfig(t, structs.NamingIndex)
+			writeTestTree(t, snapshotConfig.SnapshotsDir, test.before)
+			writeTestJournal(t, snapshotConfig, test.phase, "tmp-test-1", "test.0", test.rotations)
+
+			report, err := recoverSnapshots(snapshotConfig, false)
+			if err != nil {
+				t.Fatalf("recoverSnapshots returned %v", err)
+			}
+			if len(report.Actions) != 2 {
+				t.Errorf("got the actions %q, want the rollback and the journal removal", report.Actions)
+			}
+			assertTestTree(t, snapshotConfig.SnapshotsDir, test.after)
+		})
+	}
+}
+
+func TestRecoverSnapshotsTimestampNaming(t *testing.T) {
+	snapshotConfig := journalTestConfig(t, structs.NamingTimestamp)
+	oldDirName := GetSnapshotTimestampDirName("test", testJournalTime.Add(-time.Hour))
+	newDirName := GetSnapshotTimestampDirName("test", testJournalTime)
+	writeTestTree(t, snapshotConfig.SnapshotsDir, map[string]string{
+		"tmp-test-1/a.txt":    "new",
+		oldDirName + "/a.txt": "old",
+	})
+	if err := updateLatestLink(snapshotConfig, path.Join(snapshotConfig.SnapshotsDir, oldDirName)); err != nil {
+		t.Fatal(err)
+	}
+	journal := writeTestJournal(t, snapshotConfig, JournalPhaseCommitting, "tmp-test-1", newDirName, nil)
+	journal.UpdateLatestLink = true
+	if err := writeJournal(snapshotConfig, journal); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := recoverSnapshots(snapshotConfig, false)
+	if err != nil {
+		t.Fatalf("recoverSnapshots returned %v", err)
+	}
+	target, err := os.Readlink(GetLatestLinkPath(snapshotConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != newDirName {
+		t.Errorf("the latest link points to %s, want %s", target, newDirName)
+	}
+	if err = os.Remove(GetLatestLinkPath(snapshotConfig)); err != nil {
+		t.Fatal(err)
+	}
+	assertTestTree(t, snapshotConfig.SnapshotsDir, map[string]string{
+		oldDirName + "/":      "",
+		oldDirName + "/a.txt": "old",
+		newDirName + "/":      "",
+		newDirName + "/a.txt": "new",
+	})
+}
+
+func TestRecoverSnapshotsDryRun(t *testing.T) {
+	snapshotConfig := journalTestConfig(t, structs.NamingIndex)
+	writeTestTree(t, snapshotConfig.SnapshotsDir, map[string]string{
+		"tmp-test-1/a.txt":  "new",
+		"tmp-test-22/a.txt": "orphan",
+		"test.0/a.txt":      "0",
+	})
+	writeTestJournal(t, snapshotConfig, JournalPhaseCommitting, "tmp-test-1", "test.0", []int{0})
+	before := readTestTree(t, snapshotConfig.SnapshotsDir)
+
+	report, err := recoverSnapshots(snapshotConfig, true)
+	if err != nil {
+		t.Fatalf("recoverSnapshots returned %v", err)
+	}
+	// rolling forward, removing the journal and deleting tmp-test-22
+	if len(report.Actions) != 3 {
+		t.Errorf("got the actions %q, want 3", report.Actions)
+	}
+	if after := readTestTree(t, snapshotConfig.SnapshotsDir); !maps.Equal(before, after) {
+		t.Errorf("a dry run changed the snapshots dir from %v to %v", before, after)
+	}
+}
+
+func TestRecoverSnapshotsMissingSnapshot(t *testing.T) {
+	snapshotConfig := journalTestConfig(t, structs.NamingIndex)
+	writeTestJournal(t, snapshotConfig, JournalPhaseCommitting, "tmp-test-1", "test.0", []int{})
+
+	_, err := recoverSnapshots(snapshotConfig, false)
+	if err == nil {
+		t.Fatal("recovering a commit without the tmp dir nor the snapshot succeeded, want an error")
+	}
+	// the journal is kept, so that the recovery can be retried
+	if _, err = os.Stat(GetJournalPath(snapshotConfig)); err != nil {
+		t.Errorf("the journal was removed: %v", err)
+	}
+}
+
+func TestRecoverSnapshotsOrphanedTmpDirs(t *testing.T) {
+	snapshotConfig := journalTestConfig(t, structs.NamingIndex)
+	writeTestTree(t, snapshotConfig.SnapshotsDir, map[string]string{
+		"tmp-test-123/a.txt": "a",
+		"tmp456/a.txt":       "a",
+		// the tmp dirs of the configs test-other, testing and test-1 sharing the snapshots dir
+		"tmp-test-other-1/a.txt": "a",
+		"tmp-testing-2/a.txt":    "a",
+		"tmp-test-1-3/a.txt":     "a",
+		"tmp-test-abc/a.txt":     "a",
+		"tmp-test-":              "file",
+		"tmp-test-789":           "file",
+		"test.0/a.txt":           "0",
+	})
+
+	_, err := recoverSnapshots(snapshotConfig, false)
+	if err != nil {
+		t.Fatalf("recoverSnapshots returned %v", err)
+	}
+	assertTestTree(t, snapshotConfig.SnapshotsDir, map[string]string{
+		"tmp-test-other-1/":      "",
+		"tmp-test-other-1/a.txt": "a",
+		"tmp-testing-2/":         "",
+		"tmp-testing-2/a.txt":    "a",
+		"tmp-test-1-3/":          "",
+		"tmp-test-1-3/a.txt":     "a",
+		"tmp-test-abc/":          "",
+		"tmp-test-abc/a.txt":     "a",
+		"tmp-test-":              "file",
+		"tmp-test-789":           "file",
+		"test.0/":                "",
+		"test.0/a.txt":           "0",
+	})
+}
@@ -0,0 +1,290 @@
+package snapshots
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"snapsync/structs"
+	"snapsync/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// LatestSelector selects the newest snapshot, e.g. daily.latest
+	LatestSelector = "latest"
+)
+
+// ErrSnapshotNotFound is wrapped by the errors returned when the selected snapshot doesn't exist.
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+func isTimestampNaming(snapshotConfig *structs.SnapshotConfig) bool {
+	return snapshotConfig.Naming == structs.NamingTimestamp
+}
+
+func GetSnapshotTimestampDirName(snapshotName string, snapshotTime time.Time) string {
+	return fmt.Sprintf("%s.%s", snapshotName, snapshotTime.UTC().Format(structs.SnapshotTimeLayout))
+}
+
+// GetLatestLinkPath returns the path of the symlink to the newest snapshot, that exists only with
+// timestamp naming.
+func GetLatestLinkPath(snapshotConfig *structs.SnapshotConfig) string {
+	return path.Join(snapshotConfig.SnapshotsDir, fmt.Sprintf("%s.%s", snapshotConfig.SnapshotName, LatestSelector))
+}
+
+// ListSnapshots returns the snapshots of snapshotConfig in both the index and timestamp layouts,
+// from the newest to the oldest. The entries of the snapshots dir that are not snapshots, like the
+// tmp dirs and the latest symlink, are ignored.
+func ListSnapshots(snapshotConfig *structs.SnapshotConfig) (snapshotsInfo []*structs.SnapshotInfo, err error) {
+	snapshotsDirsEntries, err := os.ReadDir(snapshotConfig.SnapshotsDir)
+	if os.IsNotExist(err) {
+		return snapshotsInfo, nil
+	}
+	if err != nil {
+		return snapshotsInfo, fmt.Errorf("can't read directory %s: %s", snapshotConfig.SnapshotsDir, err.Error())
+	}
+	for _, entry := range snapshotsDirsEntries {
+		if !entry.IsDir() {
+			continue
+		}
+		snapshotFullPath := path.Join(snapshotConfig.SnapshotsDir, entry.Name())
+		snapshotInfo, err := utils.GetInfoFromSnapshotPath(snapshotFullPath)
+		if err != nil || snapshotInfo.SnapshotName != snapshotConfig.SnapshotName {
+			continue
+		}
+		if !snapshotInfo.Timestamped {
+			info, err := entry.Info()
+			if err != nil {
+				return snapshotsInfo, fmt.Errorf("can't stat %s: %s", snapshotFullPath, err.Error())
+			}
+			snapshotInfo.Time = info.ModTime()
+		}
+		snapshotsInfo = append(snapshotsInfo, snapshotInfo)
+	}
+	sortSnapshotsNewestFirst(snapshotsInfo)
+	return snapshotsInfo, nil
+}
+
+// sortSnapshotsNewestFirst sorts the snapshots by number with index naming and by time with timestamp
+// naming. The two layouts exist together only while migrating, in that case they are merged by time.
+func sortSnapshotsNewestFirst(snapshotsInfo []*structs.SnapshotInfo) {
+	indexed := []*structs.SnapshotInfo{}
+	timestamped := []*structs.SnapshotInfo{}
+	for _, snapshotInfo := range snapshotsInfo {
+		if snapshotInfo.Timestamped {
+			timestamped = append(timestamped, snapshotInfo)
+		} else {
+			indexed = append(indexed, snapshotInfo)
+		}
+	}
+	slices.SortFunc(indexed, func(a *structs.SnapshotInfo, b *structs.SnapshotInfo) int {
+		return a.Number - b.Number
+	})
+	slices.SortFunc(timestamped, func(a *structs.SnapshotInfo, b *structs.SnapshotInfo) int {
+		return b.Time.Compare(a.Time)
+	})
+	i, j := 0, 0
+	for k := range snapshotsInfo {
+		if j >= len(timestamped) || (i < len(indexed) && !indexed[i].Time.Before(timestamped[j].Time)) {
+			snapshotsInfo[k] = indexed[i]
+			i++
+		} else {
+			snapshotsInfo[k] = timestamped[j]
+			j++
+		}
+	}
+}
+
+// GetSnapshotInfo returns the snapshot of snapshotConfig selected by selector, that is a number, a
+// timestamp, latest or pre-restore.<timestamp>[-<index>] for a safety snapshot taken before restoring.
+func GetSnapshotInfo(snapshotConfig *structs.SnapshotConfig, selector string) (*structs.SnapshotInfo, error) {
+	if id, found := strings.CutPrefix(selector, structs.PreRestoreSelector+"."); found {
+		return getPreRestoreSnapshotInfo(snapshotConfig, id)
+	}
+	snapshotsInfo, err := ListSnapshots(snapshotConfig)
+	if err != nil {
+		return nil, err
+	}
+	if selector == LatestSelector {
+		if len(snapshotsInfo) == 0 {
+			return nil, fmt.Errorf("%w: there are no snapshots of %s", ErrSnapshotNotFound, snapshotConfig.SnapshotName)
+		}
+		return snapshotsInfo[0], nil
+	}
+	for _, snapshotInfo := range snapshotsInfo {
+		if path.Base(snapshotInfo.Abspath) == fmt.Sprintf("%s.%s", snapshotConfig.SnapshotName, selector) {
+			return snapshotInfo, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s.%s does not exist", ErrSnapshotNotFound, snapshotConfig.SnapshotName, selector)
+}
+
+// GetPreRestoreSnapshotPath returns the path of the safety snapshot taken before restoring at
+// snapshotTime. index tells apart the safety snapshots taken in the same second, the first one has
+// no suffix and the next ones end with -1, -2 and so on.
+func GetPreRestoreSnapshotPath(snapshotConfig *structs.SnapshotConfig, snapshotTime time.Time, index int) string {
+	id := snapshotTime.UTC().Format(structs.SnapshotTimeLayout)
+	if index > 0 {
+		id += fmt.Sprintf("-%d", index)
+	}
+	return path.Join(snapshotConfig.SnapshotsDir, fmt.Sprintf("%s.%s.%s", snapshotConfig.SnapshotName, structs.PreRestoreSelector, id))
+}
+
+// parsePreRestoreId parses the id of a safety snapshot, <timestamp> or <timestamp>-<index>.
+func parsePreRestoreId(id string) (snapshotTime time.Time, index int, err error) {
+	timestamp, indexString, found := strings.Cut(id, "Z-")
+	if found {
+		timestamp += "Z"
+		index, err = strconv.Atoi(indexString)
+		if err != nil || index <= 0 {
+			return time.Time{}, 0, fmt.Errorf("invalid pre-restore snapshot %s", id)
+		}
+	}
+	snapshotTime, err = time.Parse(structs.SnapshotTimeLayout, timestamp)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid pre-restore snapshot %s", id)
+	}
+	return snapshotTime, index, nil
+}
+
+func getPreRestoreSnapshotInfo(snapshotConfig *structs.SnapshotConfig, id string) (*structs.SnapshotInfo, error) {
+	snapshotTime, index, err := parsePreRestoreId(id)
+	if err != nil {
+		return nil, err
+	}
+	snapshotPath := GetPreRestoreSnapshotPath(snapshotConfig, snapshotTime, index)
+	info, err := os.Stat(snapshotPath)
+	if err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%w: %s does not exist", ErrSnapshotNotFound, path.Base(snapshotPath))
+	}
+	return &structs.SnapshotInfo{
+		Abspath:      snapshotPath,
+		SnapshotName: snapshotConfig.SnapshotName,
+		Number:       -1,
+		Time:         snapshotTime,
+		PreRestore:   true,
+	}, nil
+}
+
+// ListPreRestoreSnapshots returns the safety snapshots of snapshotConfig taken before restoring, from
+// the newest to the oldest. They are not returned by ListSnapshots, since they are not part of the
+// snapshots the retention policy applies to.
+func ListPreRestoreSnapshots(snapshotConfig *structs.SnapshotConfig) ([]*structs.SnapshotInfo, error) {
+	snapshotsDirsEntries, err := os.ReadDir(snapshotConfig.SnapshotsDir)
+	if os.IsNotExist(err) {
+		return []*structs.SnapshotInfo{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read directory %s: %s", snapshotConfig.SnapshotsDir, err.Error())
+	}
+	prefix := fmt.Sprintf("%s.%s.", snapshotConfig.SnapshotName, structs.PreRestoreSelector)
+	snapshotsInfo := []*structs.SnapshotInfo{}
+	indexes := map[*structs.SnapshotInfo]int{}
+	for _, entry := range snapshotsDirsEntries {
+		id, found := strings.CutPrefix(entry.Name(), prefix)
+		if !entry.IsDir() || !found {
+			continue
+		}
+		snapshotTime, index, err := parsePreRestoreId(id)
+		if err != nil {
+			continue
+		}
+		snapshotInfo := &structs.SnapshotInfo{
+			Abspath:      path.Join(snapshotConfig.SnapshotsDir, entry.Name()),
+			SnapshotName: snapshotConfig.SnapshotName,
+			Number:       -1,
+			Time:         snapshotTime,
+			PreRestore:   true,
+		}
+		snapshotsInfo = append(snapshotsInfo, snapshotInfo)
+		indexes[snapshotInfo] = index
+	}
+	slices.SortFunc(snapshotsInfo, func(a *structs.SnapshotInfo, b *structs.SnapshotInfo) int {
+		if compare := b.Time.Compare(a.Time); compare != 0 {
+			return compare
+		}
+		return indexes[b] - indexes[a]
+	})
+	return snapshotsInfo, nil
+}
+
+// updateLatestLink atomically points the latest symlink to snapshotPath.
+func updateLatestLink(snapshotConfig *structs.SnapshotConfig, snapshotPath string) error {
+	latestLinkPath := GetLatestLinkPath(snapshotConfig)
+	tmpLinkPath := path.Join(snapshotConfig.SnapshotsDir, "."+path.Base(latestLinkPath)+".tmp")
+	os.Remove(tmpLinkPath)
+	// the link is relative so that it keeps working when the snapshots dir is mounted elsewhere
+	err := os.Symlink(path.Base(snapshotPath), tmpLinkPath)
+	if err != nil {
+		return fmt.Errorf("can't create symlink %s: %s", tmpLinkPath, err.Error())
+	}
+	err = os.Rename(tmpLinkPath, latestLinkPath)
+	if err != nil {
+		os.Remove(tmpLinkPath)
+		return fmt.Errorf("can't update symlink %s: %s", latestLinkPath, err.Error())
+	}
+	return nil
+}
+
+// MigrateToTimestampNaming renames the snapshots named <name>.<number> to <name>.<timestamp>, using
+// their modification time as timestamp, and creates the latest symlink. The snapshot config must
+// already use the timestamp naming, so that the next snapshots are created with the new layout.
+func MigrateToTimestampNaming(snapshotConfig *structs.SnapshotConfig) (err error) {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	if !isTimestampNaming(snapshotConfig) {
+		return fmt.Errorf("%s set naming to %s in the snapshot config before migrating", snapshotLogPrefix, structs.NamingTimestamp)
+	}
+	lock, err := acquireSnapshotLock(context.Background(), snapshotConfig, "migration")
+	if err != nil {
+		return fmt.Errorf("%s %w", snapshotLogPrefix, err)
+	}
+	defer lock.Release()
+	snapshotsInfo, err := ListSnapshots(snapshotConfig)
+	if err != nil {
+		return fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	// names must be unique, so snapshots taken in the same second are moved one second apart, keeping
+	// their order. Going from the oldest, each snapshot must be newer than the previous one.
+	var previousTime time.Time
+	for i := len(snapshotsInfo) - 1; i >= 0; i-- {
+		snapshotInfo := snapshotsInfo[i]
+		if snapshotInfo.Timestamped {
+			previousTime = snapshotInfo.Time
+			continue
+		}
+		snapshotTime := snapshotInfo.Time.UTC().Truncate(time.Second)
+		if !snapshotTime.After(previousTime) {
+			snapshotTime = previousTime.Add(time.Second)
+		}
+		previousTime = snapshotTime
+		snapshotRenamedPath := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotTimestampDirName(snapshotConfig.SnapshotName, snapshotTime))
+		if _, err = os.Lstat(snapshotRenamedPath); err == nil {
+			return fmt.Errorf("%s can't move %s to %s: it already exists", snapshotLogPrefix, snapshotInfo.Abspath, snapshotRenamedPath)
+		}
+		slog.Info(fmt.Sprintf("%s renaming %s to %s", snapshotLogPrefix, snapshotInfo.Abspath, path.Base(snapshotRenamedPath)))
+		err = os.Rename(snapshotInfo.Abspath, snapshotRenamedPath)
+		if err != nil {
+			return fmt.Errorf("%s can't move %s to %s: %s", snapshotLogPrefix, snapshotInfo.Abspath, snapshotRenamedPath, err.Error())
+		}
+	}
+	snapshotsInfo, err = ListSnapshots(snapshotConfig)
+	if err != nil {
+		return fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	if len(snapshotsInfo) > 0 {
+		err = updateLatestLink(snapshotConfig, snapshotsInfo[0].Abspath)
+		if err != nil {
+			return fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+		}
+	}
+	return nil
+}
+
+func GetSnapshotDirName(snapshotName string, number int) string {
+	return fmt.Sprintf("%s.%s", snapshotName, strconv.Itoa(number))
+}
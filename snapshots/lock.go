@@ -0,0 +1,217 @@
+package snapshots
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"snapsync/structs"
+	"snapsync/utils"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultLockTimeout = time.Hour
+	lockPollInterval   = time.Second
+)
+
+var ErrLockHeld = errors.New("the snapshots dir is locked by another run")
+
+// LockHolder describes the run holding the lock of a snapshots dir.
+type LockHolder struct {
+	Pid          int       `json:"pid"`
+	SnapshotName string    `json:"snapshot_name"`
+	Operation    string    `json:"operation"`
+	Since        time.Time `json:"since"`
+}
+
+// Lockout records a run that didn't start because another run held the lock.
+type Lockout struct {
+	Time      time.Time   `json:"time"`
+	Operation string      `json:"operation"`
+	Holder    *LockHolder `json:"holder,omitempty"`
+}
+
+// SnapshotsLock is an advisory lock on a snapshots dir, so that runs sharing it never overlap.
+type SnapshotsLock struct {
+	file *os.File
+}
+
+func GetLockPath(snapshotConfig *structs.SnapshotConfig) string {
+	return path.Join(snapshotConfig.SnapshotsDir, ".snapsync.lock")
+}
+
+func getLockoutPath(snapshotConfig *structs.SnapshotConfig) string {
+	return path.Join(snapshotConfig.SnapshotsDir, fmt.Sprintf(".%s.lockout.json", snapshotConfig.SnapshotName))
+}
+
+// getLockPolicy returns the lock policy and timeout of snapshotConfig, skip by default.
+func getLockPolicy(snapshotConfig *structs.SnapshotConfig) (policy string, timeout time.Duration, err error) {
+	policy = snapshotConfig.LockPolicy
+	if len(policy) == 0 {
+		policy = structs.LockPolicySkip
+	}
+	if policy != structs.LockPolicySkip && policy != structs.LockPolicyQueue && policy != structs.LockPolicyWait {
+		return "", 0, fmt.Errorf("unknown lock policy %s", policy)
+	}
+	timeout = defaultLockTimeout
+	if len(snapshotConfig.LockTimeout) > 0 {
+		timeout, err = utils.ParseDuration(snapshotConfig.LockTimeout)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid lock_timeout: %s", err.Error())
+		}
+	}
+	return policy, timeout, nil
+}
+
+// AcquireLock locks the snapshots dir of snapshotConfig for operation. If another run holds the lock,
+// policy tells whether to give up or to wait for it, and for how long. When giving up, the returned
+// error wraps ErrLockHeld. Waiting stops when ctx is done.
+func AcquireLock(ctx context.Context, snapshotConfig *structs.SnapshotConfig, operation string, policy string, timeout time.Duration) (*SnapshotsLock, error) {
+	err := os.MkdirAll(snapshotConfig.SnapshotsDir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("can't create snapshot dir %s: %s", snapshotConfig.SnapshotsDir, err.Error())
+	}
+	lockPath := GetLockPath(snapshotConfig)
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can't open lock file %s: %s", lockPath, err.Error())
+	}
+
+	// the lock is polled instead of blocking on it, so that waiting can be interrupted
+	deadline := time.Now().Add(timeout)
+	for {
+		err = flock(file, syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK || policy == structs.LockPolicySkip || (policy == structs.LockPolicyWait && time.Now().After(deadline)) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		holder, _ := ReadLockHolder(snapshotConfig)
+		lockout := &Lockout{Time: time.Now(), Operation: operation, Holder: holder}
+		writeLockout(snapshotConfig, lockout)
+		if holder != nil {
+			return nil, fmt.Errorf("%w: pid %d is running %s of %s since %s", ErrLockHeld, holder.Pid, holder.Operation, holder.SnapshotName, holder.Since.Format(time.RFC3339))
+		}
+		return nil, ErrLockHeld
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("can't lock %s: %s", lockPath, err.Error())
+	}
+
+	holder := &LockHolder{Pid: os.Getpid(), SnapshotName: snapshotConfig.SnapshotName, Operation: operation, Since: time.Now()}
+	content, err := json.Marshal(holder)
+	if err == nil {
+		err = file.Truncate(0)
+	}
+	if err == nil {
+		_, err = file.WriteAt(content, 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("can't write lock file %s: %s", lockPath, err.Error())
+	}
+	return &SnapshotsLock{file: file}, nil
+}
+
+// acquireSnapshotLock locks the snapshots dir of snapshotConfig using its lock policy.
+func acquireSnapshotLock(ctx context.Context, snapshotConfig *structs.SnapshotConfig, operation string) (*SnapshotsLock, error) {
+	policy, timeout, err := getLockPolicy(snapshotConfig)
+	if err != nil {
+		return nil, err
+	}
+	return AcquireLock(ctx, snapshotConfig, operation, policy, timeout)
+}
+
+func (lock *SnapshotsLock) Release() error {
+	// the holder is cleared before unlocking, so that nobody reads it while another run holds the lock
+	lock.file.Truncate(0)
+	err := flock(lock.file, syscall.LOCK_UN)
+	closeErr := lock.file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// ReadLockHolder returns the run holding the lock of the snapshots dir of snapshotConfig, or nil if
+// the lock is free.
+func ReadLockHolder(snapshotConfig *structs.SnapshotConfig) (*LockHolder, error) {
+	file, err := os.Open(GetLockPath(snapshotConfig))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// if a shared lock can be taken, nobody holds the exclusive one
+	err = flock(file, syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		flock(file, syscall.LOCK_UN)
+		return nil, nil
+	}
+	if err != syscall.EWOULDBLOCK {
+		return nil, err
+	}
+	holder := &LockHolder{}
+	content, err := os.ReadFile(GetLockPath(snapshotConfig))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) == 0 {
+		return holder, nil
+	}
+	err = json.Unmarshal(content, holder)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse lock file: %s", err.Error())
+	}
+	return holder, nil
+}
+
+func writeLockout(snapshotConfig *structs.SnapshotConfig, lockout *Lockout) error {
+	content, err := json.Marshal(lockout)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(getLockoutPath(snapshotConfig), content, 0600)
+}
+
+// ReadLastLockout returns the last run of snapshotConfig that didn't start because the snapshots dir
+// was locked, or nil if there wasn't any.
+func ReadLastLockout(snapshotConfig *structs.SnapshotConfig) (*Lockout, error) {
+	content, err := os.ReadFile(getLockoutPath(snapshotConfig))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lockout := &Lockout{}
+	err = json.Unmarshal(content, lockout)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse %s: %s", getLockoutPath(snapshotConfig), err.Error())
+	}
+	return lockout, nil
+}
+
+// flock retries when interrupted by a signal.
+func flock(file *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(file.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
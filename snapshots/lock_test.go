@@ -0,0 +1,181 @@
+package snapshots
+
+import (
+	"context"
+	"errors"
+	"os"
+	"snapsync/structs"
+	"testing"
+	"time"
+)
+
+func lockTestConfig(t *testing.T) *structs.SnapshotConfig {
+	t.Helper()
+	return &structs.SnapshotConfig{SnapshotName: "test", SnapshotsDir: t.TempDir()}
+}
+
+// holdTestLock takes the lock of snapshotConfig like another run would.
+func holdTestLock(t *testing.T, snapshotConfig *structs.SnapshotConfig) *SnapshotsLock {
+	t.Helper()
+	lock, err := AcquireLock(context.Background(), snapshotConfig, "snapshot", structs.LockPolicySkip, 0)
+	if err != nil {
+		t.Fatalf("can't take the lock: %v", err)
+	}
+	return lock
+}
+
+// releaseTestLock releases lock after delay, while the test waits for it.
+func releaseTestLock(lock *SnapshotsLock, delay time.Duration) {
+	go func() {
+		time.Sleep(delay)
+		lock.Release()
+	}()
+}
+
+func TestAcquireLockFree(t *testing.T) {
+	snapshotConfig := lockTestConfig(t)
+	lock, err := AcquireLock(context.Background(), snapshotConfig, "snapshot", structs.LockPolicySkip, 0)
+	if err != nil {
+		t.Fatalf("AcquireLock returned %v", err)
+	}
+	holder, err := ReadLockHolder(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder == nil || holder.Pid != os.Getpid() || holder.Operation != "snapshot" || holder.SnapshotName != "test" {
+		t.Errorf("the lock holder is %+v, want this process taking a snapshot of test", holder)
+	}
+
+	if err = lock.Release(); err != nil {
+		t.Fatalf("Release returned %v", err)
+	}
+	holder, err = ReadLockHolder(snapshotConfig)
+	if err != nil || holder != nil {
+		t.Errorf("ReadLockHolder returned %+v, %v after the release, want nil", holder, err)
+	}
+	lock, err = AcquireLock(context.Background(), snapshotConfig, "prune", structs.LockPolicySkip, 0)
+	if err != nil {
+		t.Fatalf("AcquireLock returned %v after the release", err)
+	}
+	lock.Release()
+}
+
+func TestAcquireLockSkip(t *testing.T) {
+	snapshotConfig := lockTestConfig(t)
+	defer holdTestLock(t, snapshotConfig).Release()
+
+	start := time.Now()
+	_, err := AcquireLock(context.Background(), snapshotConfig, "prune", structs.LockPolicySkip, time.Hour)
+	if !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("AcquireLock returned %v, want ErrLockHeld", err)
+	}
+	if elapsed := time.Since(start); elapsed >= lockPollInterval {
+		t.Errorf("skipping took %s, want no wait", elapsed)
+	}
+
+	lockout, err := ReadLastLockout(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockout == nil {
+		t.Fatal("no lockout was recorded")
+	}
+	if lockout.Operation != "prune" {
+		t.Errorf("the lockout operation is %s, want prune", lockout.Operation)
+	}
+	if lockout.Holder == nil || lockout.Holder.Pid != os.Getpid() || lockout.Holder.Operation != "snapshot" {
+		t.Errorf("the lockout holder is %+v, want this process taking a snapshot", lockout.Holder)
+	}
+}
+
+func TestAcquireLockWaitTimeout(t *testing.T) {
+	snapshotConfig := lockTestConfig(t)
+	defer holdTestLock(t, snapshotConfig).Release()
+
+	timeout := lockPollInterval / 2
+	start := time.Now()
+	_, err := AcquireLock(context.Background(), snapshotConfig, "snapshot", structs.LockPolicyWait, timeout)
+	elapsed := time.Since(start)
+	if !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("AcquireLock returned %v, want ErrLockHeld", err)
+	}
+	if elapsed < timeout {
+		t.Errorf("waiting gave up after %s, before the timeout of %s", elapsed, timeout)
+	}
+	if elapsed > timeout+2*lockPollInterval {
+		t.Errorf("waiting gave up after %s, long after the timeout of %s", elapsed, timeout)
+	}
+	if lockout, _ := ReadLastLockout(snapshotConfig); lockout == nil {
+		t.Error("no lockout was recorded")
+	}
+}
+
+func TestAcquireLockWaitRelease(t *testing.T) {
+	snapshotConfig := lockTestConfig(t)
+	releaseTestLock(holdTestLock(t, snapshotConfig), lockPollInterval/2)
+
+	lock, err := AcquireLock(context.Background(), snapshotConfig, "snapshot", structs.LockPolicyWait, 3*lockPollInterval)
+	if err != nil {
+		t.Fatalf("AcquireLock returned %v, want the lock once released", err)
+	}
+	lock.Release()
+	if lockout, _ := ReadLastLockout(snapshotConfig); lockout != nil {
+		t.Errorf("a lockout was recorded: %+v", lockout)
+	}
+}
+
+func TestAcquireLockQueue(t *testing.T) {
+	snapshotConfig := lockTestConfig(t)
+	releaseTestLock(holdTestLock(t, snapshotConfig), lockPollInterval/2)
+
+	// queueing ignores the timeout
+	lock, err := AcquireLock(context.Background(), snapshotConfig, "snapshot", structs.LockPolicyQueue, 0)
+	if err != nil {
+		t.Fatalf("AcquireLock returned %v, want the lock once released", err)
+	}
+	lock.Release()
+}
+
+func TestAcquireLockQueueCanceled(t *testing.T) {
+	snapshotConfig := lockTestConfig(t)
+	defer holdTestLock(t, snapshotConfig).Release()
+	ctx, cancel := context.WithTimeout(context.Background(), lockPollInterval/2)
+	defer cancel()
+
+	_, err := AcquireLock(ctx, snapshotConfig, "snapshot", structs.LockPolicyQueue, 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("AcquireLock returned %v, want context.DeadlineExceeded", err)
+	}
+	// a canceled run wasn't locked out
+	if lockout, _ := ReadLastLockout(snapshotConfig); lockout != nil {
+		t.Errorf("a lockout was recorded: %+v", lockout)
+	}
+}
+
+func TestGetLockPolicy(t *testing.T) {
+	tests := []struct {
+		lockPolicy  string
+		lockTimeout string
+		wantPolicy  string
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{"", "", structs.LockPolicySkip, defaultLockTimeout, false},
+		{structs.LockPolicyQueue, "", structs.LockPolicyQueue, defaultLockTimeout, false},
+		{structs.LockPolicyWait, "90s", structs.LockPolicyWait, 90 * time.Second, false},
+		{structs.LockPolicyWait, "1d", structs.LockPolicyWait, 24 * time.Hour, false},
+		{structs.LockPolicyWait, "soon", "", 0, true},
+		{"retry", "", "", 0, true},
+	}
+	for _, test := range tests {
+		snapshotConfig := &structs.SnapshotConfig{LockPolicy: test.lockPolicy, LockTimeout: test.lockTimeout}
+		policy, timeout, err := getLockPolicy(snapshotConfig)
+		if (err != nil) != test.wantErr {
+			t.Errorf("getLockPolicy(%q, %q) returned the error %v", test.lockPolicy, test.lockTimeout, err)
+			continue
+		}
+		if policy != test.wantPolicy || timeout != test.wantTimeout {
+			t.Errorf("getLockPolicy(%q, %q) = %s, %s, want %s, %s", test.lockPolicy, test.lockTimeout, policy, timeout, test.wantPolicy, test.wantTimeout)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package snapshots
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"snapsync/structs"
+	"snapsync/utils"
+	"time"
+)
+
+const (
+	hookPhasePre  = "pre"
+	hookPhasePost = "post"
+)
+
+// HookError is returned when a pre or post snapshot command fails.
+type HookError struct {
+	Phase   string
+	Command string
+	// ExitCode is -1 if the command didn't exit, like when it couldn't be started
+	ExitCode int
+	Err      error
+}
+
+func (hookErr *HookError) Error() string {
+	return fmt.Sprintf("%s snapshot command %s failed: %s", hookErr.Phase, hookErr.Command, hookErr.Err.Error())
+}
+
+func (hookErr *HookError) Unwrap() error {
+	return hookErr.Err
+}
+
+func newManifest(snapshotConfig *structs.SnapshotConfig) *structs.SnapshotManifest {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return &structs.SnapshotManifest{
+		SnapshotName:    snapshotConfig.SnapshotName,
+		SnapsyncVersion: utils.GetVersion(),
+		Host:            host,
+		StartedAt:       time.Now(),
+		Status:          structs.ManifestStatusCommitted,
+		Config:          snapshotConfig,
+		Dirs:            []*structs.DirSyncStats{},
+		Hooks:           []*structs.HookResult{},
+	}
+}
+
+// writeManifest writes the manifest into the root of snapshotPath. The manifest is replaced instead of
+// rewritten, since the one cloned from the previous snapshot is a hard link to it.
+func writeManifest(snapshotPath string, manifest *structs.SnapshotManifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't encode manifest: %s", err.Error())
+	}
+	manifestPath := path.Join(snapshotPath, structs.ManifestFileName)
+	file, err := os.CreateTemp(snapshotPath, structs.ManifestFileName+".*")
+	if err != nil {
+		return fmt.Errorf("can't write manifest %s: %s", manifestPath, err.Error())
+	}
+	_, err = file.Write(content)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), manifestPath)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("can't write manifest %s: %s", manifestPath, err.Error())
+	}
+	return nil
+}
+
+// finishManifest records the end of the run in the manifest of the committed snapshot. The times of
+// the snapshot are set again since writing the manifest changes them, and with index naming they
+// are the only record of when the snapshot was taken.
+func finishManifest(snapshotPath string, manifest *structs.SnapshotManifest, runErr error) error {
+	manifest.FinishedAt = time.Now()
+	manifest.Status = structs.ManifestStatusSuccess
+	if runErr != nil {
+		manifest.Status = structs.ManifestStatusFailed
+		manifest.Error = runErr.Error()
+	}
+	err := writeManifest(snapshotPath, manifest)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(snapshotPath, manifest.SnapshotTime, manifest.SnapshotTime)
+}
+
+// runHook runs a pre or post snapshot command and records its result in the manifest. The returned
+// error is a *HookError.
+func runHook(ctx context.Context, manifest *structs.SnapshotManifest, phase string, command string) ([]byte, error) {
+	start := time.Now()
+	result, err := newCommand(ctx, "sh", "-c", command).Output()
+	hookResult := &structs.HookResult{Phase: phase, Command: command, Duration: time.Since(start)}
+	if err != nil {
+		hookResult.ExitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			hookResult.ExitCode = exitErr.ExitCode()
+		}
+		hookResult.Error = err.Error()
+		manifest.Hooks = append(manifest.Hooks, hookResult)
+		return result, &HookError{Phase: phase, Command: command, ExitCode: hookResult.ExitCode, Err: err}
+	}
+	manifest.Hooks = append(manifest.Hooks, hookResult)
+	return result, nil
+}
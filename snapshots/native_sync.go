@@ -0,0 +1,323 @@
+package snapshots
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"snapsync/structs"
+	"syscall"
+)
+
+// NativeSyncer syncs the directories without external executables, with the same semantics of
+// rsync -aLK --delete: symlinks in the source are followed, files are considered unchanged when
+// their size and modification time match (or their content if Checksum is set), changed files are
+// written to a new inode so that the hard links to the previous snapshots are broken, and the
+// entries that don't exist in the source anymore are deleted, unless they are excluded.
+type NativeSyncer struct {
+	Checksum bool
+}
+
+type nativeSync struct {
+	ctx    context.Context
+	syncer *NativeSyncer
+	filter *pathFilter
+	// the directories being synced, to avoid loops caused by symlinks
+	visiting map[fileID]bool
+	stats    *structs.SyncStats
+	errs     []error
+}
+
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+func (syncer *NativeSyncer) Sync(ctx context.Context, srcDir string, dstDir string, options *SyncOptions) (*structs.SyncStats, error) {
+	filter, err := newPathFilter(options)
+	if err != nil {
+		return nil, err
+	}
+	srcInfo, err := os.Stat(srcDir)
+	if err != nil {
+		return nil, fmt.Errorf("can't stat %s: %s", srcDir, err.Error())
+	}
+	if !srcInfo.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", srcDir)
+	}
+	err = os.MkdirAll(dstDir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("can't create %s: %s", dstDir, err.Error())
+	}
+	state := &nativeSync{ctx: ctx, syncer: syncer, filter: filter, visiting: map[fileID]bool{}, stats: &structs.SyncStats{}}
+	state.syncDir(srcDir, dstDir, "", srcInfo)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(state.errs) > 0 {
+		return nil, &SyncError{
+			Command: fmt.Sprintf("native sync of %s/ to %s", srcDir, dstDir),
+			Err:     fmt.Errorf("%d errors: %w", len(state.errs), errors.Join(state.errs...)),
+		}
+	}
+	return state.stats, nil
+}
+
+func (state *nativeSync) addError(format string, args ...any) {
+	state.errs = append(state.errs, fmt.Errorf(format, args...))
+}
+
+// syncDir syncs the content of srcDir into dstDir, that must exist, then copies the metadata of srcDir.
+func (state *nativeSync) syncDir(srcDir string, dstDir string, relDir string, srcInfo fs.FileInfo) {
+	id := getFileID(srcInfo)
+	if state.visiting[id] {
+		state.addError("%s: symlink loop detected", srcDir)
+		return
+	}
+	state.visiting[id] = true
+	defer delete(state.visiting, id)
+
+	srcEntries, err := os.ReadDir(srcDir)
+	if err != nil {
+		state.addError("can't read %s: %s", srcDir, err.Error())
+		return
+	}
+	srcNames := map[string]bool{}
+	for _, srcEntry := range srcEntries {
+		// a half synced directory must not be deleted from, or have its metadata copied
+		if state.ctx.Err() != nil {
+			return
+		}
+		srcPath := path.Join(srcDir, srcEntry.Name())
+		dstPath := path.Join(dstDir, srcEntry.Name())
+		relPath := path.Join(relDir, srcEntry.Name())
+		// like rsync -L, symlinks are replaced by what they point to
+		srcEntryInfo, err := os.Stat(srcPath)
+		if err != nil {
+			// an excluded dangling symlink must not be reported, so check the exclusion first
+			if !state.filter.isExcluded(relPath, false) {
+				state.addError("can't stat %s: %s", srcPath, err.Error())
+			}
+			// keep what's already in the destination, as rsync does for the files that vanished
+			srcNames[srcEntry.Name()] = true
+			continue
+		}
+		if state.filter.isExcluded(relPath, srcEntryInfo.IsDir()) {
+			continue
+		}
+		srcNames[srcEntry.Name()] = true
+		switch mode := srcEntryInfo.Mode(); {
+		case mode.IsDir():
+			if !state.prepareDstDir(dstPath) {
+				continue
+			}
+			state.syncDir(srcPath, dstPath, relPath, srcEntryInfo)
+		case mode.IsRegular():
+			state.syncFile(srcPath, dstPath, srcEntryInfo)
+		default:
+			state.syncSpecialFile(srcPath, dstPath, srcEntryInfo)
+		}
+	}
+
+	// delete what doesn't exist anymore in the source
+	dstEntries, err := os.ReadDir(dstDir)
+	if err != nil {
+		state.addError("can't read %s: %s", dstDir, err.Error())
+	} else {
+		for _, dstEntry := range dstEntries {
+			if srcNames[dstEntry.Name()] {
+				continue
+			}
+			if state.filter.isExcluded(path.Join(relDir, dstEntry.Name()), dstEntry.IsDir()) {
+				continue
+			}
+			dstPath := path.Join(dstDir, dstEntry.Name())
+			deleted := countEntries(dstPath)
+			if err = os.RemoveAll(dstPath); err != nil {
+				state.addError("can't delete %s: %s", dstPath, err.Error())
+				continue
+			}
+			state.stats.FilesDeleted += deleted
+		}
+	}
+
+	if err = copyMetadata(dstDir, srcInfo); err != nil {
+		state.addError("%s: %s", dstDir, err.Error())
+	}
+}
+
+// prepareDstDir makes sure that dstPath is a directory, replacing whatever was there before. Like
+// rsync -K, a symlink to a directory in the destination is treated as a directory.
+func (state *nativeSync) prepareDstDir(dstPath string) bool {
+	dstInfo, err := os.Stat(dstPath)
+	if err == nil && dstInfo.IsDir() {
+		return true
+	}
+	if err = os.RemoveAll(dstPath); err != nil {
+		state.addError("can't delete %s: %s", dstPath, err.Error())
+		return false
+	}
+	if err = os.Mkdir(dstPath, 0700); err != nil {
+		state.addError("can't create %s: %s", dstPath, err.Error())
+		return false
+	}
+	return true
+}
+
+func (state *nativeSync) syncFile(srcPath string, dstPath string, srcInfo fs.FileInfo) {
+	state.stats.SnapshotBytes += srcInfo.Size()
+	dstInfo, err := os.Lstat(dstPath)
+	if err == nil && dstInfo.Mode().IsRegular() && sameMetadata(srcInfo, dstInfo) {
+		if !state.syncer.Checksum {
+			return
+		}
+		same, err := sameContent(srcPath, dstPath)
+		if err != nil {
+			state.addError("can't compare %s and %s: %s", srcPath, dstPath, err.Error())
+			return
+		}
+		if same {
+			return
+		}
+	}
+	if err = replaceWithCopy(srcPath, dstPath, srcInfo); err != nil {
+		state.addError("can't copy %s to %s: %s", srcPath, dstPath, err.Error())
+		return
+	}
+	state.stats.FilesTransferred++
+	state.stats.BytesTransferred += srcInfo.Size()
+}
+
+func (state *nativeSync) syncSpecialFile(srcPath string, dstPath string, srcInfo fs.FileInfo) {
+	dstInfo, err := os.Lstat(dstPath)
+	if err == nil && dstInfo.Mode() == srcInfo.Mode() && getRdev(dstInfo) == getRdev(srcInfo) && sameMetadata(srcInfo, dstInfo) {
+		return
+	}
+	if err = os.RemoveAll(dstPath); err != nil {
+		state.addError("can't delete %s: %s", dstPath, err.Error())
+		return
+	}
+	if err = cloneSpecialFile(dstPath, srcInfo); err != nil {
+		state.addError("can't copy %s to %s: %s", srcPath, dstPath, err.Error())
+		return
+	}
+	state.stats.FilesTransferred++
+}
+
+// countEntries returns the number of entries in the tree rooted at root, root included, as rsync
+// counts the deleted files.
+func countEntries(root string) int64 {
+	count := int64(0)
+	filepath.WalkDir(root, func(_ string, _ fs.DirEntry, err error) error {
+		if err == nil {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+// replaceWithCopy copies srcPath into a new file that then replaces dstPath, so that the other hard
+// links to dstPath are not modified.
+func replaceWithCopy(srcPath string, dstPath string, srcInfo fs.FileInfo) error {
+	if dstInfo, err := os.Lstat(dstPath); err == nil && dstInfo.IsDir() {
+		if err = os.RemoveAll(dstPath); err != nil {
+			return err
+		}
+	}
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	tmpFile, err := os.CreateTemp(path.Dir(dstPath), "."+path.Base(dstPath)+".*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	_, err = io.Copy(tmpFile, srcFile)
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = copyMetadata(tmpPath, srcInfo)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dstPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// sameMetadata tells if two files have the same size, modification time, mode and ownership.
+func sameMetadata(srcInfo fs.FileInfo, dstInfo fs.FileInfo) bool {
+	if srcInfo.Size() != dstInfo.Size() || !srcInfo.ModTime().Equal(dstInfo.ModTime()) || srcInfo.Mode() != dstInfo.Mode() {
+		return false
+	}
+	return sameOwnership(srcInfo, dstInfo)
+}
+
+// sameOwnership tells if two files have the same owner and group, as far as the sync is concerned.
+func sameOwnership(srcInfo fs.FileInfo, dstInfo fs.FileInfo) bool {
+	srcStat, srcOk := srcInfo.Sys().(*syscall.Stat_t)
+	dstStat, dstOk := dstInfo.Sys().(*syscall.Stat_t)
+	if !srcOk || !dstOk {
+		return true
+	}
+	// when running unprivileged the ownership can't be copied, so it's not compared
+	if os.Geteuid() != 0 {
+		return true
+	}
+	return srcStat.Uid == dstStat.Uid && srcStat.Gid == dstStat.Gid
+}
+
+func sameContent(srcPath string, dstPath string) (bool, error) {
+	srcHash, err := hashFile(srcPath)
+	if err != nil {
+		return false, err
+	}
+	dstHash, err := hashFile(dstPath)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(srcHash, dstHash), nil
+}
+
+func hashFile(filePath string) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+func getFileID(info fs.FileInfo) fileID {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+}
+
+func getRdev(info fs.FileInfo) uint64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(stat.Rdev)
+}
@@ -0,0 +1,287 @@
+package snapshots
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testFilesTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// writeTestTree creates the files in root, by path relative to root. A path ending with / is a
+// directory. All the files get the same modification time.
+func writeTestTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for relPath, content := range files {
+		filePath := path.Join(root, relPath)
+		if relPath[len(relPath)-1] == '/' {
+			if err := os.MkdirAll(filePath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filePath, testFilesTime, testFilesTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTestTree returns the files in root by path relative to root, the directories end with /.
+func readTestTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(root, func(filePath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil || relPath == "." {
+			return err
+		}
+		if entry.IsDir() {
+			files[relPath+"/"] = ""
+			return nil
+		}
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		files[relPath] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func assertTestTree(t *testing.T, root string, want map[string]string) {
+	t.Helper()
+	got := readTestTree(t, root)
+	for relPath, content := range want {
+		gotContent, ok := got[relPath]
+		if !ok {
+			t.Errorf("%s is missing", relPath)
+		} else if gotContent != content {
+			t.Errorf("%s contains %q, want %q", relPath, gotContent, content)
+		}
+	}
+	for relPath := range got {
+		if _, ok := want[relPath]; !ok {
+			t.Errorf("%s should not exist", relPath)
+		}
+	}
+}
+
+func TestNativeSyncCopiesAndDeletes(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeTestTree(t, src, map[string]string{
+		"a.txt":         "a",
+		"dir/b.txt":     "b",
+		"dir/sub/c.txt": "c",
+		"empty/":        "",
+	})
+	writeTestTree(t, dst, map[string]string{
+		"a.txt":           "old",
+		"gone.txt":        "gone",
+		"gonedir/x.txt":   "x",
+		"gonedir/y/z.txt": "z",
+		"dir/gone.txt":    "gone",
+	})
+
+	stats, err := (&NativeSyncer{}).Sync(context.Background(), src, dst, &SyncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTestTree(t, dst, map[string]string{
+		"a.txt":         "a",
+		"dir/":          "",
+		"dir/b.txt":     "b",
+		"dir/sub/":      "",
+		"dir/sub/c.txt": "c",
+		"empty/":        "",
+	})
+	if stats.FilesTransferred != 3 {
+		t.Errorf("FilesTransferred = %d, want 3", stats.FilesTransferred)
+	}
+	// gonedir, gonedir/x.txt, gonedir/y, gonedir/y/z.txt, gone.txt and dir/gone.txt
+	if stats.FilesDeleted != 6 {
+		t.Errorf("FilesDeleted = %d, want 6", stats.FilesDeleted)
+	}
+	info, err := os.Stat(path.Join(dst, "dir/b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(testFilesTime) {
+		t.Errorf("the modification time of dir/b.txt is %s, want %s", info.ModTime(), testFilesTime)
+	}
+}
+
+func TestNativeSyncKeepsExcludedEntries(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeTestTree(t, src, map[string]string{
+		"a.txt":       "a",
+		"a.log":       "log",
+		"cache/x.txt": "x",
+	})
+	writeTestTree(t, dst, map[string]string{
+		"old.log":         "old log",
+		"cache/stale.txt": "stale",
+		"other.txt":       "other",
+	})
+
+	_, err := (&NativeSyncer{}).Sync(context.Background(), src, dst, &SyncOptions{Excludes: []string{"*.log", "/cache/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the excluded entries are neither copied nor deleted, like rsync --delete without --delete-excluded
+	assertTestTree(t, dst, map[string]string{
+		"a.txt":           "a",
+		"old.log":         "old log",
+		"cache/":          "",
+		"cache/stale.txt": "stale",
+	})
+}
+
+func TestNativeSyncIncludePrecedence(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeTestTree(t, src, map[string]string{
+		"keep.log":              "keep",
+		"drop.log":              "drop",
+		"app/node_modules/b.js": "b",
+		"app/main.js":           "main",
+	})
+
+	options := &SyncOptions{
+		Includes: []string{"keep.log"},
+		Excludes: []string{"*.log", "**/node_modules"},
+	}
+	_, err := (&NativeSyncer{}).Sync(context.Background(), src, dst, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTestTree(t, dst, map[string]string{
+		"keep.log":    "keep",
+		"app/":        "",
+		"app/main.js": "main",
+	})
+}
+
+func TestNativeSyncAnchoredPatterns(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeTestTree(t, src, map[string]string{
+		"tmp/a":        "a",
+		"home/tmp/b":   "b",
+		"home/c.bak":   "c",
+		"home/x/d.bak": "d",
+	})
+
+	_, err := (&NativeSyncer{}).Sync(context.Background(), src, dst, &SyncOptions{Excludes: []string{"/tmp", "/home/*.bak"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTestTree(t, dst, map[string]string{
+		"home/":        "",
+		"home/tmp/":    "",
+		"home/tmp/b":   "b",
+		"home/x/":      "",
+		"home/x/d.bak": "d",
+	})
+}
+
+func TestNativeSyncBreaksHardLinks(t *testing.T) {
+	src, dst, previous := t.TempDir(), t.TempDir(), t.TempDir()
+	writeTestTree(t, src, map[string]string{"changed.txt": "changed", "same.txt": "same"})
+	writeTestTree(t, previous, map[string]string{"changed.txt": "old", "same.txt": "same"})
+	// dst is cloned from the previous snapshot, like when taking a snapshot
+	for _, name := range []string{"changed.txt", "same.txt"} {
+		if err := os.Link(path.Join(previous, name), path.Join(dst, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := (&NativeSyncer{}).Sync(context.Background(), src, dst, &SyncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTestTree(t, dst, map[string]string{"changed.txt": "changed", "same.txt": "same"})
+	assertTestTree(t, previous, map[string]string{"changed.txt": "old", "same.txt": "same"})
+	if stats.FilesTransferred != 1 {
+		t.Errorf("FilesTransferred = %d, want 1", stats.FilesTransferred)
+	}
+	sameInfo, _ := os.Stat(path.Join(dst, "same.txt"))
+	previousInfo, _ := os.Stat(path.Join(previous, "same.txt"))
+	if !os.SameFile(sameInfo, previousInfo) {
+		t.Error("the unchanged same.txt was rewritten instead of staying hard linked")
+	}
+}
+
+func TestNativeSyncChecksum(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	// same size and modification time, different content
+	writeTestTree(t, src, map[string]string{"a.txt": "new"})
+	writeTestTree(t, dst, map[string]string{"a.txt": "old"})
+
+	_, err := (&NativeSyncer{}).Sync(context.Background(), src, dst, &SyncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTestTree(t, dst, map[string]string{"a.txt": "old"})
+
+	_, err = (&NativeSyncer{Checksum: true}).Sync(context.Background(), src, dst, &SyncOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTestTree(t, dst, map[string]string{"a.txt": "new"})
+}
+
+func TestNativeSyncFollowsSymlinks(t *testing.T) {
+	src, dst, outside := t.TempDir(), t.TempDir(), t.TempDir()
+	writeTestTree(t, outside, map[string]string{"target/t.txt": "t"})
+	if err := os.Symlink(path.Join(outside, "target"), path.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".", path.Join(src, "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := (&NativeSyncer{}).Sync(context.Background(), src, dst, &SyncOptions{Excludes: []string{"/loop"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTestTree(t, dst, map[string]string{"link/": "", "link/t.txt": "t"})
+
+	_, err = (&NativeSyncer{}).Sync(context.Background(), src, dst, &SyncOptions{})
+	if err == nil {
+		t.Fatal("syncing a symlink loop succeeded, want an error")
+	}
+	var syncErr *SyncError
+	if !errors.As(err, &syncErr) {
+		t.Errorf("the error %q is not a *SyncError", err.Error())
+	}
+}
+
+func TestNativeSyncInterrupted(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeTestTree(t, src, map[string]string{"a.txt": "a"})
+	writeTestTree(t, dst, map[string]string{"b.txt": "b"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := (&NativeSyncer{}).Sync(ctx, src, dst, &SyncOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Sync returned %v, want context.Canceled", err)
+	}
+	// nothing is deleted from a directory that wasn't completely synced
+	assertTestTree(t, dst, map[string]string{"b.txt": "b"})
+}
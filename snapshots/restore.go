@@ -0,0 +1,525 @@
+package snapshots
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"snapsync/structs"
+	"strings"
+	"time"
+)
+
+const (
+	// RestoreLayoutSnapshot restores into the target dir with the layout of the snapshot, where each
+	// dir is in its dst_dir_in_snapshot
+	RestoreLayoutSnapshot = "snapshot"
+	// RestoreLayoutSource restores into the target dir with the layout of the sources, where each dir
+	// is in its src_dir_abspath
+	RestoreLayoutSource = "source"
+)
+
+// RestoreOptions tell what to restore of a snapshot, and where.
+type RestoreOptions struct {
+	// Paths are the paths to restore, relative to the root of the snapshot, like
+	// home/etc/nginx. They can contain the * ? and [] wildcards. If empty, all the dirs of the
+	// snapshot config are restored.
+	Paths []string
+	// Target is the absolute path of the dir to restore into instead of the sources, if not empty
+	Target string
+	// TargetLayout is how the restored dirs are laid out inside Target, RestoreLayoutSnapshot by default
+	TargetLayout string
+	// PreRestoreSnapshot takes a safety snapshot of the sources before restoring over them, so that
+	// the restore can be undone restoring the safety snapshot
+	PreRestoreSnapshot bool
+	// FailFast stops the restore at the first dir that can't be restored, instead of going on with
+	// the other dirs
+	FailFast bool
+	// Confirm is called with the plan of the restore before changing anything and before taking the
+	// lock, and the restore goes on only if it returns true. If nil the restore isn't confirmed.
+	Confirm func(plan *RestorePlan) bool
+}
+
+// ErrRestoreNotConfirmed is returned when the plan of the restore is not confirmed.
+var ErrRestoreNotConfirmed = errors.New("restore not confirmed")
+
+// ErrRestorePlanChanged is returned when the files changed after the plan of the restore was confirmed.
+var ErrRestorePlanChanged = errors.New("the files changed after the restore was confirmed, nothing was restored, run it again")
+
+// RestoreDirError is the failure of restoring a dir of the snapshot, or a file with --path.
+type RestoreDirError struct {
+	SnapshotPath string
+	TargetPath   string
+	Err          error
+}
+
+func (dirErr *RestoreDirError) Error() string {
+	return fmt.Sprintf("can't restore %s to %s: %s", dirErr.SnapshotPath, dirErr.TargetPath, dirErr.Err.Error())
+}
+
+func (dirErr *RestoreDirError) Unwrap() error {
+	return dirErr.Err
+}
+
+// RestoreError is returned when some dirs of the snapshot couldn't be restored. The other dirs were
+// restored, except the Skipped ones when the restore stops at the first failure.
+type RestoreError struct {
+	Snapshot string
+	Failed   []*RestoreDirError
+	Restored int
+	Skipped  int
+}
+
+func (restoreErr *RestoreError) Error() string {
+	message := fmt.Sprintf("%d of %d dirs of %s not restored", len(restoreErr.Failed), len(restoreErr.Failed)+restoreErr.Restored+restoreErr.Skipped, restoreErr.Snapshot)
+	if restoreErr.Skipped > 0 {
+		message += fmt.Sprintf(", %d skipped after the first failure", restoreErr.Skipped)
+	}
+	for _, dirErr := range restoreErr.Failed {
+		message += "; " + dirErr.Error()
+	}
+	return message
+}
+
+func (restoreErr *RestoreError) Unwrap() []error {
+	errs := make([]error, 0, len(restoreErr.Failed))
+	for _, dirErr := range restoreErr.Failed {
+		errs = append(errs, dirErr)
+	}
+	return errs
+}
+
+// RestoreDirPlan is what restoring a dir of the snapshot, or a file with --path, changes in its
+// target. The paths are the absolute paths in the target, the directories end with a slash.
+type RestoreDirPlan struct {
+	SnapshotPath string   `json:"snapshot_path"`
+	TargetPath   string   `json:"target_path"`
+	Create       []string `json:"create"`
+	Update       []string `json:"update"`
+	Delete       []string `json:"delete"`
+}
+
+type RestorePlanSummary struct {
+	Create int `json:"create"`
+	Update int `json:"update"`
+	Delete int `json:"delete"`
+}
+
+// RestorePlan is what a restore changes.
+type RestorePlan struct {
+	Snapshot string             `json:"snapshot"`
+	Target   string             `json:"target,omitempty"`
+	Dirs     []*RestoreDirPlan  `json:"dirs"`
+	Summary  RestorePlanSummary `json:"summary"`
+}
+
+// IsEmpty tells if the restore wouldn't change anything.
+func (plan *RestorePlan) IsEmpty() bool {
+	return plan.Summary.Create == 0 && plan.Summary.Update == 0 && plan.Summary.Delete == 0
+}
+
+// restoreItem is a file or directory of the snapshot restored over its source, or into the target.
+type restoreItem struct {
+	snapshotDir *structs.SnapshotDir
+	// snapshotPath is in the snapshot, targetPath is where it's restored to
+	snapshotPath string
+	targetPath   string
+	isDir        bool
+}
+
+func RestoreSnapshot(ctx context.Context, config *structs.Config, snapshotInfo *structs.SnapshotInfo, snapshotConfig *structs.SnapshotConfig, options *RestoreOptions) (err error) {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	syncer, err := GetSyncer(config, snapshotConfig)
+	if err != nil {
+		return fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	// the restore is confirmed before taking the lock, so that waiting for an answer doesn't block
+	// the scheduled snapshots
+	plan, err := PlanRestore(snapshotInfo, snapshotConfig, options)
+	if err != nil {
+		return fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	if plan.IsEmpty() {
+		slog.Info(fmt.Sprintf("%s nothing to restore, the files already match %s", snapshotLogPrefix, snapshotInfo.CompactName()))
+		return nil
+	}
+	if options.Confirm != nil && !options.Confirm(plan) {
+		return fmt.Errorf("%s %w", snapshotLogPrefix, ErrRestoreNotConfirmed)
+	}
+	lock, err := acquireSnapshotLock(ctx, snapshotConfig, "restore")
+	if err != nil {
+		return fmt.Errorf("%s %w", snapshotLogPrefix, err)
+	}
+	defer lock.Release()
+	// the files may have changed while waiting for the confirmation and the lock, and only the
+	// confirmed changes can be made
+	items, err := planRestoreItems(snapshotInfo, snapshotConfig, options)
+	if err != nil {
+		return fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	lockedPlan, err := planRestore(snapshotInfo, options, items)
+	if err != nil {
+		return fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	if !reflect.DeepEqual(plan, lockedPlan) {
+		return fmt.Errorf("%s %w", snapshotLogPrefix, ErrRestorePlanChanged)
+	}
+	// with a target outside the sources there is nothing to save, but a target inside a source
+	// overwrites it like a restore over the sources does
+	if options.PreRestoreSnapshot && restoresOverSources(snapshotConfig, options, items) {
+		preRestoreSnapshotPath, err := takePreRestoreSnapshot(ctx, config, snapshotConfig, syncer)
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s restore interrupted: %w", snapshotLogPrefix, ctx.Err())
+		}
+		if err != nil {
+			return fmt.Errorf("%s can't take the pre-restore snapshot, nothing was restored: %w", snapshotLogPrefix, err)
+		}
+		slog.Info(fmt.Sprintf("%s saved the current state in %s, restore it to undo this restore", snapshotLogPrefix, path.Base(preRestoreSnapshotPath)))
+	}
+	restoreErr := &RestoreError{Snapshot: snapshotInfo.CompactName(), Failed: []*RestoreDirError{}}
+	for i, item := range items {
+		if options.FailFast && len(restoreErr.Failed) > 0 {
+			restoreErr.Skipped = len(items) - i
+			break
+		}
+		targetDir, snapshottedDirPath, syncOptions := getRestoreSync(snapshotInfo, item)
+		err = os.MkdirAll(targetDir, 0700)
+		if err != nil {
+			restoreErr.Failed = append(restoreErr.Failed, &RestoreDirError{
+				SnapshotPath: item.snapshotPath,
+				TargetPath:   item.targetPath,
+				Err:          fmt.Errorf("can't create directory %s: %w", targetDir, err),
+			})
+			continue
+		}
+
+		slog.Debug(fmt.Sprintf("%s syncing %s to %s", snapshotLogPrefix, item.snapshotPath, item.targetPath))
+		_, err = syncer.Sync(ctx, snapshottedDirPath, targetDir, syncOptions)
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s restore interrupted: %w", snapshotLogPrefix, ctx.Err())
+		}
+		if err != nil {
+			restoreErr.Failed = append(restoreErr.Failed, &RestoreDirError{SnapshotPath: item.snapshotPath, TargetPath: item.targetPath, Err: err})
+			continue
+		}
+		restoreErr.Restored++
+	}
+	if len(restoreErr.Failed) > 0 {
+		return fmt.Errorf("%s %w", snapshotLogPrefix, restoreErr)
+	}
+	return nil
+}
+
+// PlanRestore returns what restoring snapshotInfo with options would change, without changing anything.
+func PlanRestore(snapshotInfo *structs.SnapshotInfo, snapshotConfig *structs.SnapshotConfig, options *RestoreOptions) (*RestorePlan, error) {
+	items, err := planRestoreItems(snapshotInfo, snapshotConfig, options)
+	if err != nil {
+		return nil, err
+	}
+	return planRestore(snapshotInfo, options, items)
+}
+
+func planRestore(snapshotInfo *structs.SnapshotInfo, options *RestoreOptions, items []*restoreItem) (*RestorePlan, error) {
+	plan := &RestorePlan{Snapshot: snapshotInfo.CompactName(), Target: options.Target, Dirs: []*RestoreDirPlan{}}
+	for _, item := range items {
+		dirPlan, err := planRestoreItem(snapshotInfo, item)
+		if err != nil {
+			return nil, err
+		}
+		plan.Dirs = append(plan.Dirs, dirPlan)
+		plan.Summary.Create += len(dirPlan.Create)
+		plan.Summary.Update += len(dirPlan.Update)
+		plan.Summary.Delete += len(dirPlan.Delete)
+	}
+	return plan, nil
+}
+
+// planRestoreItem compares the item in the snapshot with its target, with the same rules of the sync:
+// the files with a different size, modification time, mode or, when running as root, ownership are
+// updated.
+func planRestoreItem(snapshotInfo *structs.SnapshotInfo, item *restoreItem) (*RestoreDirPlan, error) {
+	dirPlan := &RestoreDirPlan{
+		SnapshotPath: item.snapshotPath,
+		TargetPath:   item.targetPath,
+		Create:       []string{},
+		Update:       []string{},
+		Delete:       []string{},
+	}
+	if !item.isDir {
+		snapshotFileInfo, err := os.Stat(item.snapshotPath)
+		if err != nil {
+			return nil, fmt.Errorf("can't stat %s: %s", item.snapshotPath, err.Error())
+		}
+		targetInfo, err := os.Lstat(item.targetPath)
+		switch {
+		case os.IsNotExist(err):
+			dirPlan.Create = append(dirPlan.Create, item.targetPath)
+		case err != nil:
+			return nil, fmt.Errorf("can't stat %s: %s", item.targetPath, err.Error())
+		case !targetInfo.Mode().IsRegular() || !sameMetadata(snapshotFileInfo, targetInfo):
+			dirPlan.Update = append(dirPlan.Update, item.targetPath)
+		}
+		return dirPlan, nil
+	}
+
+	diff, err := diffTrees(item.targetPath, item.snapshotPath, item.snapshotPath == snapshotInfo.Abspath)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range diff.Entries {
+		entryPath := path.Join(item.targetPath, entry.Path)
+		if entry.IsDir {
+			entryPath += "/"
+		}
+		switch entry.Change {
+		case DiffAdded:
+			dirPlan.Create = append(dirPlan.Create, entryPath)
+		case DiffModified:
+			dirPlan.Update = append(dirPlan.Update, entryPath)
+		case DiffRemoved:
+			dirPlan.Delete = append(dirPlan.Delete, entryPath)
+		}
+	}
+	return dirPlan, nil
+}
+
+// takePreRestoreSnapshot snapshots the current state of the sources into a safety snapshot, that isn't
+// deleted by the retention policy. Like the regular snapshots, it's cloned from the latest snapshot
+// so that only what changed since then is copied.
+func takePreRestoreSnapshot(ctx context.Context, config *structs.Config, snapshotConfig *structs.SnapshotConfig, syncer Syncer) (snapshotPath string, err error) {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	snapshotTime := time.Now()
+	err = os.MkdirAll(snapshotConfig.SnapshotsDir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("can't create snapshot dir %s: %s", snapshotConfig.SnapshotsDir, err.Error())
+	}
+	tmpDir, err := os.MkdirTemp(snapshotConfig.SnapshotsDir, getTmpDirPattern(snapshotConfig))
+	if err != nil {
+		return "", fmt.Errorf("can't create tmp dir: %s", err.Error())
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+
+	snapshotsInfo, err := ListSnapshots(snapshotConfig)
+	if err != nil {
+		return "", err
+	}
+	if len(snapshotsInfo) > 0 {
+		cloneErrors, err := cloneSnapshot(ctx, config, snapshotConfig, snapshotsInfo[0].Abspath, tmpDir)
+		for _, cloneError := range cloneErrors {
+			slog.Warn(fmt.Sprintf("%s can't clone %s", snapshotLogPrefix, cloneError.Error()))
+		}
+		if err != nil {
+			return "", fmt.Errorf("error copying last snapshot %s to %s: %s", snapshotsInfo[0].Abspath, tmpDir, err.Error())
+		}
+	}
+	for _, metadataFile := range metadataFiles {
+		os.Remove(path.Join(tmpDir, metadataFile))
+	}
+
+	for _, dir := range snapshotConfig.Dirs {
+		dstDirFull := path.Join(tmpDir, dir.DstDirInSnapshot)
+		if _, err = os.Stat(dir.SrcDirAbspath); os.IsNotExist(err) {
+			// what was cloned from the latest snapshot didn't exist before restoring
+			if dstDirFull != tmpDir {
+				os.RemoveAll(dstDirFull)
+			}
+			continue
+		}
+		err = os.MkdirAll(dstDirFull, 0700)
+		if err != nil {
+			return "", fmt.Errorf("can't create destination dir %s: %s", dstDirFull, err.Error())
+		}
+		slog.Debug(fmt.Sprintf("%s syncing %s/ to %s", snapshotLogPrefix, dir.SrcDirAbspath, dstDirFull))
+		_, err = syncer.Sync(ctx, dir.SrcDirAbspath, dstDirFull, getSnapshotDirSyncOptions(&dir))
+		if err != nil {
+			return "", fmt.Errorf("can't sync %s/ to %s: %w", dir.SrcDirAbspath, dstDirFull, err)
+		}
+	}
+	os.Chtimes(tmpDir, snapshotTime, snapshotTime)
+	// the lock is held, so the first free name can't be taken by another restore before the rename
+	for index := 0; ; index++ {
+		snapshotPath = GetPreRestoreSnapshotPath(snapshotConfig, snapshotTime, index)
+		if _, err = os.Lstat(snapshotPath); os.IsNotExist(err) {
+			break
+		}
+	}
+	err = os.Rename(tmpDir, snapshotPath)
+	if err != nil {
+		return "", fmt.Errorf("can't rename temp directory %s to %s: %s", tmpDir, snapshotPath, err.Error())
+	}
+	return snapshotPath, nil
+}
+
+// getRestoreSync returns the directories to sync to restore item, and the options of the sync. A
+// file is restored syncing its parent directory with only the file included, so that the other
+// files in the directory are not touched.
+func getRestoreSync(snapshotInfo *structs.SnapshotInfo, item *restoreItem) (targetDir string, snapshottedDirPath string, syncOptions *SyncOptions) {
+	if !item.isDir {
+		return path.Dir(item.targetPath), path.Dir(item.snapshotPath), &SyncOptions{
+			Includes: []string{"/" + escapePattern(path.Base(item.targetPath))},
+			Excludes: []string{"*"},
+		}
+	}
+	syncOptions = &SyncOptions{}
+	// the metadata files are in the root of the snapshot, but they are not snapshotted files
+	if item.snapshotPath == snapshotInfo.Abspath {
+		for _, metadataFile := range metadataFiles {
+			syncOptions.Excludes = append(syncOptions.Excludes, "/"+metadataFile)
+		}
+	}
+	return item.targetPath, item.snapshotPath, syncOptions
+}
+
+// getRestoreRoot returns where the root of dir is restored to.
+func getRestoreRoot(dir *structs.SnapshotDir, options *RestoreOptions) string {
+	if len(options.Target) == 0 {
+		return dir.SrcDirAbspath
+	}
+	if options.TargetLayout == RestoreLayoutSource {
+		return path.Join(options.Target, dir.SrcDirAbspath)
+	}
+	return path.Join(options.Target, dir.DstDirInSnapshot)
+}
+
+// planRestoreItems maps the paths of the snapshot matching options.Paths to the paths of the sources
+// they were taken from, through dst_dir_in_snapshot and src_dir_abspath, or to the paths in the
+// target. A match containing whole dirs of the snapshot config restores them all. Without paths all
+// the dirs are restored.
+func planRestoreItems(snapshotInfo *structs.SnapshotInfo, snapshotConfig *structs.SnapshotConfig, options *RestoreOptions) ([]*restoreItem, error) {
+	switch options.TargetLayout {
+	case "", RestoreLayoutSnapshot, RestoreLayoutSource:
+	default:
+		return nil, fmt.Errorf("unknown target layout %s, must be %s or %s", options.TargetLayout, RestoreLayoutSnapshot, RestoreLayoutSource)
+	}
+	if len(options.Target) > 0 {
+		if !path.IsAbs(options.Target) {
+			return nil, fmt.Errorf("the target %s must be an absolute path", options.Target)
+		}
+	}
+
+	matches := []string{}
+	if len(options.Paths) == 0 {
+		matches = append(matches, "")
+	}
+	for _, pattern := range options.Paths {
+		pattern = strings.TrimPrefix(path.Clean("/"+pattern), "/")
+		patternMatches, err := filepath.Glob(path.Join(snapshotInfo.Abspath, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %s: %s", pattern, err.Error())
+		}
+		found := false
+		for _, match := range patternMatches {
+			relPath, err := filepath.Rel(snapshotInfo.Abspath, match)
+			if err != nil {
+				return nil, err
+			}
+			if relPath == "." {
+				relPath = ""
+			}
+			if isMetadataFile(relPath) {
+				continue
+			}
+			matches = append(matches, relPath)
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("%s doesn't match any path of %s", pattern, snapshotInfo.CompactName())
+		}
+	}
+
+	// a match inside another match is already restored by it. Once sorted by length, a path comes
+	// after the paths it's inside
+	slices.SortStableFunc(matches, func(a string, b string) int {
+		return len(a) - len(b)
+	})
+	outerMatches := []string{}
+	for _, match := range matches {
+		if !slices.ContainsFunc(outerMatches, func(outer string) bool { return isInsideRelPath(match, outer) }) {
+			outerMatches = append(outerMatches, match)
+		}
+	}
+
+	items := []*restoreItem{}
+	for _, match := range outerMatches {
+		matched := false
+		for i := range snapshotConfig.Dirs {
+			dir := &snapshotConfig.Dirs[i]
+			dstDir := strings.TrimPrefix(path.Clean("/"+dir.DstDirInSnapshot), "/")
+			switch {
+			case isInsideRelPath(match, dstDir):
+				relPath := strings.TrimPrefix(strings.TrimPrefix(match, dstDir), "/")
+				info, err := os.Lstat(path.Join(snapshotInfo.Abspath, match))
+				if err != nil {
+					return nil, fmt.Errorf("can't stat %s: %s", path.Join(snapshotInfo.Abspath, match), err.Error())
+				}
+				items = append(items, &restoreItem{
+					snapshotDir:  dir,
+					snapshotPath: path.Join(snapshotInfo.Abspath, match),
+					targetPath:   path.Join(getRestoreRoot(dir, options), relPath),
+					isDir:        info.IsDir(),
+				})
+				matched = true
+			case isInsideRelPath(dstDir, match):
+				items = append(items, &restoreItem{
+					snapshotDir:  dir,
+					snapshotPath: path.Join(snapshotInfo.Abspath, dstDir),
+					targetPath:   getRestoreRoot(dir, options),
+					isDir:        true,
+				})
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("%s is not inside any dst_dir_in_snapshot of %s", match, snapshotConfig.SnapshotName)
+		}
+	}
+
+	// restoring into the snapshots would change the snapshots being restored, and restoring to a
+	// directory containing them would delete them, since they are not in the snapshot
+	snapshotsDir := strings.TrimPrefix(path.Clean(snapshotConfig.SnapshotsDir), "/")
+	for _, item := range items {
+		targetPath := strings.TrimPrefix(path.Clean(item.targetPath), "/")
+		if isInsideRelPath(targetPath, snapshotsDir) || isInsideRelPath(snapshotsDir, targetPath) {
+			return nil, fmt.Errorf("can't restore to %s: it overlaps with the snapshots dir %s", item.targetPath, snapshotConfig.SnapshotsDir)
+		}
+	}
+	return items, nil
+}
+
+// restoresOverSources tells if restoring items changes the sources of the snapshot config, that is
+// always the case without a target, otherwise only if a target path overlaps with a source dir.
+func restoresOverSources(snapshotConfig *structs.SnapshotConfig, options *RestoreOptions, items []*restoreItem) bool {
+	if len(options.Target) == 0 {
+		return true
+	}
+	for _, item := range items {
+		targetPath := strings.TrimPrefix(path.Clean(item.targetPath), "/")
+		for _, dir := range snapshotConfig.Dirs {
+			srcDir := strings.TrimPrefix(path.Clean(dir.SrcDirAbspath), "/")
+			if isInsideRelPath(targetPath, srcDir) || isInsideRelPath(srcDir, targetPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isInsideRelPath tells if the clean relative path relPath is parent or is inside it. The empty path
+// is the root.
+func isInsideRelPath(relPath string, parent string) bool {
+	return parent == "" || relPath == parent || strings.HasPrefix(relPath, parent+"/")
+}
+
+// escapePattern escapes the wildcards of name, so that it matches only itself as an rsync pattern.
+func escapePattern(name string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(name)
+}
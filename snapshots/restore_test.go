@@ -0,0 +1,54 @@
+package snapshots
+
+import (
+	"path"
+	"snapsync/structs"
+	"strings"
+	"testing"
+)
+
+func TestPlanRestoreItemsSnapshotsDir(t *testing.T) {
+	root := t.TempDir()
+	snapshotsDir := path.Join(root, "backups/snapshots")
+	snapshotInfo := &structs.SnapshotInfo{SnapshotName: "test", Abspath: path.Join(snapshotsDir, "test.0")}
+	writeTestTree(t, snapshotInfo.Abspath, map[string]string{"home/a.txt": "a", "backups/b.txt": "b"})
+	snapshotConfig := &structs.SnapshotConfig{
+		SnapshotName: "test",
+		SnapshotsDir: snapshotsDir,
+		Dirs: []structs.SnapshotDir{
+			{SrcDirAbspath: path.Join(root, "home"), DstDirInSnapshot: "home"},
+			{SrcDirAbspath: path.Join(root, "backups"), DstDirInSnapshot: "backups"},
+		},
+	}
+	tests := []struct {
+		name    string
+		options *RestoreOptions
+		wantErr bool
+	}{
+		{"target outside", &RestoreOptions{Target: path.Join(root, "restored"), Paths: []string{"home"}}, false},
+		{"target inside", &RestoreOptions{Target: path.Join(snapshotsDir, "restored"), Paths: []string{"home"}}, true},
+		{"target is the snapshots dir", &RestoreOptions{Target: snapshotsDir + "/", Paths: []string{"home"}}, true},
+		{"target sharing a prefix", &RestoreOptions{Target: snapshotsDir + "-restored", Paths: []string{"home"}}, false},
+		{"destination containing the snapshots dir", &RestoreOptions{Target: root, Paths: []string{"backups"}}, true},
+		{"target is the parent of the snapshots dir", &RestoreOptions{Target: path.Join(root, "backups"), Paths: []string{"home"}}, false},
+		{"file in the parent of the snapshots dir", &RestoreOptions{Target: root, Paths: []string{"backups/b.txt"}}, false},
+		{"source layout into the root", &RestoreOptions{Target: "/", TargetLayout: RestoreLayoutSource, Paths: []string{"home"}}, false},
+		{"source layout containing the snapshots dir", &RestoreOptions{Target: "/", TargetLayout: RestoreLayoutSource, Paths: []string{"backups"}}, true},
+		{"source containing the snapshots dir", &RestoreOptions{Paths: []string{"backups"}}, true},
+		{"all the sources", &RestoreOptions{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items, err := planRestoreItems(snapshotInfo, snapshotConfig, test.options)
+			if test.wantErr && (err == nil || !strings.Contains(err.Error(), "overlaps with the snapshots dir")) {
+				t.Errorf("planRestoreItems returned %v, want an overlap with the snapshots dir", err)
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("planRestoreItems returned %v", err)
+			}
+			if !test.wantErr && len(items) != 1 {
+				t.Errorf("planRestoreItems returned %d items, want 1", len(items))
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package snapshots
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"snapsync/structs"
+	"snapsync/utils"
+	"time"
+)
+
+// RetentionDecision tells if a snapshot is kept by the retention policy, and the reasons why.
+type RetentionDecision struct {
+	Snapshot *structs.SnapshotInfo
+	Keep     bool
+	Reasons  []string
+	// Deleted is set once the snapshot not kept is actually deleted
+	Deleted bool
+}
+
+type retentionBucket struct {
+	name  string
+	count int
+	// key returns the same value for the snapshots in the same period
+	key func(snapshotTime time.Time) string
+}
+
+// GetRetentionPolicy returns the retention policy of snapshotConfig. If the config doesn't have a
+// retention_policy block, the retention count is used to keep the last snapshots.
+func GetRetentionPolicy(snapshotConfig *structs.SnapshotConfig) *structs.RetentionPolicy {
+	if snapshotConfig.RetentionPolicy != nil {
+		return snapshotConfig.RetentionPolicy
+	}
+	return &structs.RetentionPolicy{KeepLast: snapshotConfig.Retention}
+}
+
+// isEmptyRetentionPolicy tells if policy doesn't keep any snapshot. A keep_within that isn't a positive
+// duration doesn't keep any.
+func isEmptyRetentionPolicy(policy *structs.RetentionPolicy) bool {
+	keepWithin, err := utils.ParseDuration(policy.KeepWithin)
+	return policy.KeepLast <= 0 && policy.KeepHourly <= 0 && policy.KeepDaily <= 0 && policy.KeepWeekly <= 0 &&
+		policy.KeepMonthly <= 0 && policy.KeepYearly <= 0 && (err != nil || keepWithin <= 0)
+}
+
+// PlanRetention decides which snapshots the policy keeps. The snapshots must be sorted from the newest,
+// as returned by ListSnapshots, and the decisions are returned in the same order.
+//
+// keep_last keeps the newest snapshots. keep_hourly, keep_daily, keep_weekly, keep_monthly and
+// keep_yearly keep the newest snapshot of each of the last periods that have snapshots, in local time.
+// keep_within keeps the snapshots taken within the duration before the newest snapshot, so that
+// nothing is deleted just because snapshots stopped being taken.
+func PlanRetention(snapshotsInfo []*structs.SnapshotInfo, policy *structs.RetentionPolicy) ([]*RetentionDecision, error) {
+	var keepWithin time.Duration
+	if len(policy.KeepWithin) > 0 {
+		var err error
+		keepWithin, err = utils.ParseDuration(policy.KeepWithin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keep_within: %s", err.Error())
+		}
+		if keepWithin <= 0 {
+			return nil, fmt.Errorf("invalid keep_within: %s is not a positive duration", policy.KeepWithin)
+		}
+	}
+	if isEmptyRetentionPolicy(policy) {
+		return nil, fmt.Errorf("the retention policy doesn't keep any snapshot")
+	}
+
+	decisions := make([]*RetentionDecision, len(snapshotsInfo))
+	for i, snapshotInfo := range snapshotsInfo {
+		decisions[i] = &RetentionDecision{Snapshot: snapshotInfo}
+	}
+	keep := func(decision *RetentionDecision, reason string) {
+		decision.Keep = true
+		decision.Reasons = append(decision.Reasons, reason)
+	}
+
+	for i := 0; i < policy.KeepLast && i < len(decisions); i++ {
+		keep(decisions[i], fmt.Sprintf("last %d", policy.KeepLast))
+	}
+
+	buckets := []retentionBucket{
+		{name: "hourly", count: policy.KeepHourly, key: func(t time.Time) string { return t.Local().Format("2006-01-02 15") }},
+		{name: "daily", count: policy.KeepDaily, key: func(t time.Time) string { return t.Local().Format("2006-01-02") }},
+		{name: "weekly", count: policy.KeepWeekly, key: func(t time.Time) string {
+			year, week := t.Local().ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{name: "monthly", count: policy.KeepMonthly, key: func(t time.Time) string { return t.Local().Format("2006-01") }},
+		{name: "yearly", count: policy.KeepYearly, key: func(t time.Time) string { return t.Local().Format("2006") }},
+	}
+	for _, bucket := range buckets {
+		kept := 0
+		lastKey := ""
+		for _, decision := range decisions {
+			if kept >= bucket.count {
+				break
+			}
+			key := bucket.key(decision.Snapshot.Time)
+			if key == lastKey {
+				continue
+			}
+			lastKey = key
+			kept++
+			keep(decision, fmt.Sprintf("%s snapshot %s", bucket.name, key))
+		}
+	}
+
+	if keepWithin > 0 && len(decisions) > 0 {
+		newestTime := decisions[0].Snapshot.Time
+		for _, decision := range decisions {
+			if !decision.Snapshot.Time.Before(newestTime.Add(-keepWithin)) {
+				keep(decision, fmt.Sprintf("within %s", policy.KeepWithin))
+			}
+		}
+	}
+	return decisions, nil
+}
+
+// PruneSnapshots deletes the snapshots of snapshotConfig that are not kept by policy, or only plans
+// what to delete if dryRun is set, and returns the decision taken for each snapshot.
+func PruneSnapshots(snapshotConfig *structs.SnapshotConfig, policy *structs.RetentionPolicy, dryRun bool) ([]*RetentionDecision, error) {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	lock, err := acquireSnapshotLock(context.Background(), snapshotConfig, "prune")
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", snapshotLogPrefix, err)
+	}
+	defer lock.Release()
+	return pruneSnapshots(snapshotConfig, policy, dryRun)
+}
+
+// PrunePreRestoreSnapshots deletes the safety snapshots of snapshotConfig taken before restoring that
+// are not kept by policy, or only plans what to delete if dryRun is set. The safety snapshots are
+// not pruned with the other snapshots, so that a restore can be undone until they are pruned this way.
+func PrunePreRestoreSnapshots(snapshotConfig *structs.SnapshotConfig, policy *structs.RetentionPolicy, dryRun bool) ([]*RetentionDecision, error) {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	lock, err := acquireSnapshotLock(context.Background(), snapshotConfig, "prune")
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", snapshotLogPrefix, err)
+	}
+	defer lock.Release()
+	snapshotsInfo, err := ListPreRestoreSnapshots(snapshotConfig)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	return removeSnapshots(snapshotConfig, snapshotsInfo, policy, dryRun)
+}
+
+// pruneSnapshots is PruneSnapshots for the callers already holding the lock.
+func pruneSnapshots(snapshotConfig *structs.SnapshotConfig, policy *structs.RetentionPolicy, dryRun bool) ([]*RetentionDecision, error) {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	snapshotsInfo, err := ListSnapshots(snapshotConfig)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	return removeSnapshots(snapshotConfig, snapshotsInfo, policy, dryRun)
+}
+
+// removeSnapshots deletes the snapshots in snapshotsInfo, sorted from the newest, that are not kept by policy.
+func removeSnapshots(snapshotConfig *structs.SnapshotConfig, snapshotsInfo []*structs.SnapshotInfo, policy *structs.RetentionPolicy, dryRun bool) ([]*RetentionDecision, error) {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	decisions, err := PlanRetention(snapshotsInfo, policy)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	if dryRun {
+		return decisions, nil
+	}
+	for _, decision := range decisions {
+		if decision.Keep {
+			continue
+		}
+		slog.Debug(fmt.Sprintf("removing %s", decision.Snapshot.Abspath))
+		err = os.RemoveAll(decision.Snapshot.Abspath)
+		if err != nil {
+			return decisions, fmt.Errorf("%s can't remove snapshot %s: %s", snapshotLogPrefix, decision.Snapshot.Abspath, err.Error())
+		}
+		decision.Deleted = true
+	}
+	return decisions, nil
+}
@@ -0,0 +1,244 @@
+package snapshots
+
+import (
+	"slices"
+	"snapsync/structs"
+	"testing"
+	"time"
+)
+
+// retentionTestSnapshots returns a snapshot for each time, that must be sorted from the newest.
+func retentionTestSnapshots(times []time.Time) []*structs.SnapshotInfo {
+	snapshotsInfo := make([]*structs.SnapshotInfo, len(times))
+	for i, snapshotTime := range times {
+		snapshotsInfo[i] = &structs.SnapshotInfo{SnapshotName: "test", Number: i, Time: snapshotTime}
+	}
+	return snapshotsInfo
+}
+
+func retentionTestTime(year int, month time.Month, day int, hour int, minute int) time.Time {
+	return time.Date(year, month, day, hour, minute, 0, 0, time.Local)
+}
+
+func TestPlanRetention(t *testing.T) {
+	tests := []struct {
+		name   string
+		times  []time.Time
+		policy *structs.RetentionPolicy
+		// kept are the indexes of the kept snapshots
+		kept []int
+		// reasons are the expected reasons of some of the kept snapshots
+		reasons map[int][]string
+	}{
+		{
+			name: "keep_last",
+			times: []time.Time{
+				retentionTestTime(2024, 3, 10, 12, 0),
+				retentionTestTime(2024, 3, 10, 11, 0),
+				retentionTestTime(2024, 3, 10, 10, 0),
+				retentionTestTime(2024, 3, 10, 9, 0),
+			},
+			policy:  &structs.RetentionPolicy{KeepLast: 2},
+			kept:    []int{0, 1},
+			reasons: map[int][]string{0: {"last 2"}},
+		},
+		{
+			name: "keep_last more than the snapshots",
+			times: []time.Time{
+				retentionTestTime(2024, 3, 10, 12, 0),
+				retentionTestTime(2024, 3, 10, 11, 0),
+			},
+			policy: &structs.RetentionPolicy{KeepLast: 5},
+			kept:   []int{0, 1},
+		},
+		{
+			name: "keep_hourly keeps the newest of each hour",
+			times: []time.Time{
+				retentionTestTime(2024, 3, 10, 10, 50),
+				retentionTestTime(2024, 3, 10, 10, 10),
+				retentionTestTime(2024, 3, 10, 9, 30),
+				retentionTestTime(2024, 3, 10, 8, 0),
+			},
+			policy:  &structs.RetentionPolicy{KeepHourly: 2},
+			kept:    []int{0, 2},
+			reasons: map[int][]string{2: {"hourly snapshot 2024-03-10 09"}},
+		},
+		{
+			name: "keep_daily skips the days without snapshots",
+			times: []time.Time{
+				retentionTestTime(2024, 3, 10, 23, 0),
+				retentionTestTime(2024, 3, 10, 1, 0),
+				retentionTestTime(2024, 3, 7, 12, 0),
+				retentionTestTime(2024, 3, 6, 12, 0),
+			},
+			policy:  &structs.RetentionPolicy{KeepDaily: 2},
+			kept:    []int{0, 2},
+			reasons: map[int][]string{2: {"daily snapshot 2024-03-07"}},
+		},
+		{
+			name: "keep_weekly with ISO weeks across the new year",
+			times: []time.Time{
+				// Sunday and Monday of the ISO week 1 of 2025, that starts in 2024
+				retentionTestTime(2025, 1, 5, 12, 0),
+				retentionTestTime(2024, 12, 30, 12, 0),
+				// Sunday of the last ISO week of 2024
+				retentionTestTime(2024, 12, 29, 12, 0),
+				retentionTestTime(2024, 12, 23, 12, 0),
+			},
+			policy: &structs.RetentionPolicy{KeepWeekly: 2},
+			kept:   []int{0, 2},
+			reasons: map[int][]string{
+				0: {"weekly snapshot 2025-W01"},
+				2: {"weekly snapshot 2024-W52"},
+			},
+		},
+		{
+			name: "keep_weekly splits Sunday and Monday",
+			times: []time.Time{
+				retentionTestTime(2024, 3, 11, 12, 0),
+				retentionTestTime(2024, 3, 10, 12, 0),
+			},
+			policy: &structs.RetentionPolicy{KeepWeekly: 2},
+			kept:   []int{0, 1},
+		},
+		{
+			name: "keep_monthly",
+			times: []time.Time{
+				retentionTestTime(2024, 3, 1, 12, 0),
+				retentionTestTime(2024, 2, 29, 12, 0),
+				retentionTestTime(2024, 2, 1, 12, 0),
+				retentionTestTime(2024, 1, 31, 12, 0),
+			},
+			policy:  &structs.RetentionPolicy{KeepMonthly: 2},
+			kept:    []int{0, 1},
+			reasons: map[int][]string{1: {"monthly snapshot 2024-02"}},
+		},
+		{
+			name: "keep_yearly",
+			times: []time.Time{
+				retentionTestTime(2024, 1, 1, 0, 30),
+				retentionTestTime(2023, 12, 31, 23, 30),
+				retentionTestTime(2023, 1, 1, 12, 0),
+				retentionTestTime(2022, 6, 1, 12, 0),
+			},
+			policy:  &structs.RetentionPolicy{KeepYearly: 3},
+			kept:    []int{0, 1, 3},
+			reasons: map[int][]string{3: {"yearly snapshot 2022"}},
+		},
+		{
+			name: "keep_within is measured from the newest snapshot",
+			times: []time.Time{
+				retentionTestTime(2020, 5, 1, 12, 0),
+				retentionTestTime(2020, 5, 1, 11, 0),
+				retentionTestTime(2020, 5, 1, 10, 0),
+				retentionTestTime(2020, 5, 1, 9, 0),
+			},
+			policy:  &structs.RetentionPolicy{KeepWithin: "2h"},
+			kept:    []int{0, 1, 2},
+			reasons: map[int][]string{2: {"within 2h"}},
+		},
+		{
+			name: "keep_within in days",
+			times: []time.Time{
+				retentionTestTime(2020, 5, 8, 12, 0),
+				retentionTestTime(2020, 5, 2, 12, 0),
+				retentionTestTime(2020, 4, 30, 12, 0),
+			},
+			policy: &structs.RetentionPolicy{KeepWithin: "7d"},
+			kept:   []int{0, 1},
+		},
+		{
+			name: "overlapping rules add their reasons",
+			times: []time.Time{
+				retentionTestTime(2024, 3, 10, 12, 0),
+				retentionTestTime(2024, 3, 9, 12, 0),
+				retentionTestTime(2024, 3, 8, 12, 0),
+			},
+			policy: &structs.RetentionPolicy{KeepLast: 1, KeepDaily: 2, KeepWithin: "1d"},
+			kept:   []int{0, 1},
+			reasons: map[int][]string{
+				0: {"last 1", "daily snapshot 2024-03-10", "within 1d"},
+				1: {"daily snapshot 2024-03-09", "within 1d"},
+			},
+		},
+		{
+			name:   "no snapshots",
+			times:  []time.Time{},
+			policy: &structs.RetentionPolicy{KeepLast: 3},
+			kept:   []int{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decisions, err := PlanRetention(retentionTestSnapshots(test.times), test.policy)
+			if err != nil {
+				t.Fatalf("PlanRetention returned %v", err)
+			}
+			if len(decisions) != len(test.times) {
+				t.Fatalf("got %d decisions, want %d", len(decisions), len(test.times))
+			}
+			kept := []int{}
+			for i, decision := range decisions {
+				if decision.Snapshot.Number != i {
+					t.Errorf("decision %d is about snapshot %d", i, decision.Snapshot.Number)
+				}
+				if decision.Keep {
+					kept = append(kept, i)
+				}
+			}
+			if !slices.Equal(kept, test.kept) {
+				t.Errorf("kept %v, want %v", kept, test.kept)
+			}
+			for i, reasons := range test.reasons {
+				if !slices.Equal(decisions[i].Reasons, reasons) {
+					t.Errorf("reasons of %d are %q, want %q", i, decisions[i].Reasons, reasons)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanRetentionInvalidPolicies(t *testing.T) {
+	policies := map[string]*structs.RetentionPolicy{
+		"empty":                                  {},
+		"negative counts":                        {KeepLast: -1, KeepDaily: -3},
+		"zero keep_within":                       {KeepWithin: "0s"},
+		"zero keep_within days":                  {KeepWithin: "0d"},
+		"negative keep_within":                   {KeepWithin: "-1h"},
+		"invalid keep_within":                    {KeepWithin: "1q"},
+		"zero keep_within with a negative count": {KeepLast: -1, KeepWithin: "0"},
+		"zero keep_within with a valid count":    {KeepLast: 2, KeepWithin: "0s"},
+	}
+	snapshotsInfo := retentionTestSnapshots([]time.Time{
+		retentionTestTime(2024, 3, 10, 12, 0),
+		retentionTestTime(2024, 3, 9, 12, 0),
+	})
+	for name, policy := range policies {
+		t.Run(name, func(t *testing.T) {
+			decisions, err := PlanRetention(snapshotsInfo, policy)
+			if err == nil {
+				t.Fatalf("PlanRetention returned %d decisions, want an error", len(decisions))
+			}
+		})
+	}
+}
+
+func TestIsEmptyRetentionPolicy(t *testing.T) {
+	tests := []struct {
+		policy *structs.RetentionPolicy
+		want   bool
+	}{
+		{&structs.RetentionPolicy{}, true},
+		{&structs.RetentionPolicy{KeepWithin: "0s"}, true},
+		{&structs.RetentionPolicy{KeepWithin: "-1h"}, true},
+		{&structs.RetentionPolicy{KeepWithin: "soon"}, true},
+		{&structs.RetentionPolicy{KeepWithin: "1h"}, false},
+		{&structs.RetentionPolicy{KeepYearly: 1}, false},
+		{&structs.RetentionPolicy{KeepLast: 0, KeepHourly: -1}, true},
+	}
+	for _, test := range tests {
+		if got := isEmptyRetentionPolicy(test.policy); got != test.want {
+			t.Errorf("isEmptyRetentionPolicy(%+v) = %t, want %t", *test.policy, got, test.want)
+		}
+	}
+}
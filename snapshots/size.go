@@ -0,0 +1,358 @@
+package snapshots
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"runtime"
+	"snapsync/structs"
+	"strings"
+	"sync"
+)
+
+// sizeCacheVersion must be increased every time the format of the cached scans changes
+const sizeCacheVersion = 1
+
+// SnapshotSize is the space used by a snapshot of a set of snapshots sharing their files through
+// hard links.
+type SnapshotSize struct {
+	Snapshot *structs.SnapshotInfo
+	// Apparent is the sum of the sizes of all the files, as if none of them was hard linked
+	Apparent int64
+	// Unique is the size of the files that are not hard linked with other snapshots of the set, that
+	// deleting the snapshot would free
+	Unique int64
+	// Shared is the size of the files hard linked with other snapshots of the set
+	Shared int64
+	// Err is set if the snapshot couldn't be walked, then its files are not counted
+	Err error
+}
+
+// SnapshotsSize is the space used by a set of snapshots.
+type SnapshotsSize struct {
+	Snapshots []*SnapshotSize
+	// DiskUsage is the size of all the files of the set, counting the hard linked files once
+	DiskUsage int64
+}
+
+// SizeOptions tune how the snapshots are walked.
+type SizeOptions struct {
+	// Workers is the number of directories read concurrently, the number of CPUs if 0
+	Workers int
+	// CacheDir is where the walks of the snapshots are cached, if not empty. Since the snapshots don't
+	// change after being taken, a snapshot is walked only the first time its size is requested.
+	CacheDir string
+}
+
+// snapshotScan is what walking a snapshot finds out: its apparent size and its distinct files.
+type snapshotScan struct {
+	Version   int
+	RootDev   uint64
+	RootIno   uint64
+	RootMtime int64
+	Apparent  int64
+	Inodes    []scannedInode
+}
+
+type scannedInode struct {
+	Dev  uint64
+	Ino  uint64
+	Size int64
+}
+
+func GetSizeCacheDir(snapshotConfig *structs.SnapshotConfig) string {
+	return path.Join(snapshotConfig.SnapshotsDir, fmt.Sprintf(".%s.sizes", snapshotConfig.SnapshotName))
+}
+
+// GetSnapshotsSize returns the space used by each snapshot of snapshotsInfo, that must be snapshots of
+// the same config, telling apart the files unique to each snapshot from the files it shares through
+// hard links with the others, and the disk usage of the whole set.
+func GetSnapshotsSize(snapshotsInfo []*structs.SnapshotInfo, options *SizeOptions) *SnapshotsSize {
+	workers := options.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	setSize := &SnapshotsSize{}
+	scans := make([]*snapshotScan, len(snapshotsInfo))
+	for i, snapshotInfo := range snapshotsInfo {
+		size := &SnapshotSize{Snapshot: snapshotInfo}
+		setSize.Snapshots = append(setSize.Snapshots, size)
+		scan, err := getSnapshotScan(snapshotInfo, workers, options.CacheDir)
+		if err != nil {
+			size.Err = err
+			continue
+		}
+		scans[i] = scan
+		size.Apparent = scan.Apparent
+	}
+	if len(options.CacheDir) > 0 {
+		removeStaleScans(options.CacheDir, snapshotsInfo)
+	}
+
+	// the number of snapshots each file is in
+	snapshotsCount := map[fileID]int{}
+	for _, scan := range scans {
+		if scan == nil {
+			continue
+		}
+		for _, inode := range scan.Inodes {
+			id := fileID{dev: inode.Dev, ino: inode.Ino}
+			if snapshotsCount[id] == 0 {
+				setSize.DiskUsage += inode.Size
+			}
+			snapshotsCount[id]++
+		}
+	}
+	for i, scan := range scans {
+		if scan == nil {
+			continue
+		}
+		for _, inode := range scan.Inodes {
+			if snapshotsCount[fileID{dev: inode.Dev, ino: inode.Ino}] == 1 {
+				setSize.Snapshots[i].Unique += inode.Size
+			} else {
+				setSize.Snapshots[i].Shared += inode.Size
+			}
+		}
+	}
+	return setSize
+}
+
+// getSnapshotScan walks the snapshot, or reads the walk from the cache if the snapshot was already
+// walked.
+func getSnapshotScan(snapshotInfo *structs.SnapshotInfo, workers int, cacheDir string) (*snapshotScan, error) {
+	rootInfo, err := os.Stat(snapshotInfo.Abspath)
+	if err != nil {
+		return nil, fmt.Errorf("can't stat %s: %s", snapshotInfo.Abspath, err.Error())
+	}
+	rootID := getFileID(rootInfo)
+	cacheFile := getScanCacheFile(rootID)
+	if len(cacheDir) > 0 {
+		scan, err := readCachedScan(path.Join(cacheDir, cacheFile))
+		if err == nil && scan.Version == sizeCacheVersion && scan.RootDev == rootID.dev && scan.RootIno == rootID.ino && scan.RootMtime == rootInfo.ModTime().UnixNano() {
+			return scan, nil
+		}
+	}
+
+	scan, err := scanSnapshot(snapshotInfo.Abspath, workers)
+	if err != nil {
+		return nil, err
+	}
+	scan.Version = sizeCacheVersion
+	scan.RootDev = rootID.dev
+	scan.RootIno = rootID.ino
+	scan.RootMtime = rootInfo.ModTime().UnixNano()
+	if len(cacheDir) > 0 {
+		err = writeCachedScan(cacheDir, cacheFile, scan)
+		if err != nil {
+			// the cache only speeds things up, so the size is returned anyway
+			slog.Debug(fmt.Sprintf("can't cache the size of %s: %s", snapshotInfo.Abspath, err.Error()))
+		}
+	}
+	return scan, nil
+}
+
+// getScanCacheFile returns the name of the cache file of the snapshot whose root is rootID. The
+// snapshots are renamed when rotating them, so the cache is keyed by inode.
+func getScanCacheFile(rootID fileID) string {
+	return fmt.Sprintf("%d-%d.gob", rootID.dev, rootID.ino)
+}
+
+// scanSnapshot walks the tree rooted at root reading workers directories at a time. The files hard
+// linked more than once inside the tree are counted once.
+func scanSnapshot(root string, workers int) (*snapshotScan, error) {
+	queue := newDirQueue(root)
+	results := make([]*snapshotScan, workers)
+	errs := make([]error, workers)
+	seen := make([]map[fileID]bool, workers)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		results[worker] = &snapshotScan{}
+		seen[worker] = map[fileID]bool{}
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for {
+				dir, ok := queue.pop()
+				if !ok {
+					return
+				}
+				subDirs, err := scanDir(dir, results[worker], seen[worker])
+				if err != nil && errs[worker] == nil {
+					errs[worker] = err
+				}
+				queue.done(subDirs)
+			}
+		}(worker)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the same file can be found by more workers, if hard linked in different directories
+	scan := &snapshotScan{}
+	merged := map[fileID]bool{}
+	for _, result := range results {
+		scan.Apparent += result.Apparent
+		for _, inode := range result.Inodes {
+			id := fileID{dev: inode.Dev, ino: inode.Ino}
+			if merged[id] {
+				continue
+			}
+			merged[id] = true
+			scan.Inodes = append(scan.Inodes, inode)
+		}
+	}
+	return scan, nil
+}
+
+// scanDir adds the files of dir to scan, and returns its subdirectories.
+func scanDir(dir string, scan *snapshotScan, seen map[fileID]bool) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %s", dir, err.Error())
+	}
+	subDirs := []string{}
+	for _, entry := range entries {
+		entryPath := path.Join(dir, entry.Name())
+		if entry.IsDir() {
+			subDirs = append(subDirs, entryPath)
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return subDirs, fmt.Errorf("can't stat %s: %s", entryPath, err.Error())
+		}
+		scan.Apparent += info.Size()
+		id := getFileID(info)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		scan.Inodes = append(scan.Inodes, scannedInode{Dev: id.dev, Ino: id.ino, Size: info.Size()})
+	}
+	return subDirs, nil
+}
+
+// dirQueue hands out the directories to read to the workers, and tells them when there is nothing
+// left to read.
+type dirQueue struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	dirs  []string
+	// the directories being read, that can still add subdirectories
+	reading int
+}
+
+func newDirQueue(root string) *dirQueue {
+	queue := &dirQueue{dirs: []string{root}}
+	queue.cond = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+// pop returns the next directory to read, waiting for one if there is none but some directories
+// are still being read. It returns false when all the directories were read.
+func (queue *dirQueue) pop() (string, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	for len(queue.dirs) == 0 && queue.reading > 0 {
+		queue.cond.Wait()
+	}
+	if len(queue.dirs) == 0 {
+		return "", false
+	}
+	dir := queue.dirs[len(queue.dirs)-1]
+	queue.dirs = queue.dirs[:len(queue.dirs)-1]
+	queue.reading++
+	return dir, true
+}
+
+// done adds the subdirectories of a directory returned by pop after reading it.
+func (queue *dirQueue) done(subDirs []string) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.dirs = append(queue.dirs, subDirs...)
+	queue.reading--
+	queue.cond.Broadcast()
+}
+
+func readCachedScan(cachePath string) (*snapshotScan, error) {
+	file, err := os.Open(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scan := &snapshotScan{}
+	err = gob.NewDecoder(file).Decode(scan)
+	if err != nil {
+		return nil, err
+	}
+	return scan, nil
+}
+
+func writeCachedScan(cacheDir string, cacheFile string, scan *snapshotScan) error {
+	err := os.MkdirAll(cacheDir, 0700)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(cacheDir, "tmp-*-"+cacheFile)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(file).Encode(scan)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path.Join(cacheDir, cacheFile))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// removeStaleScans deletes the cached walks of the snapshots that don't exist anymore. Every directory
+// next to the snapshots of snapshotsInfo keeps its walk, so that the walks of the snapshots that were
+// not requested this time survive.
+func removeStaleScans(cacheDir string, snapshotsInfo []*structs.SnapshotInfo) {
+	snapshotsDirs := map[string]bool{}
+	for _, snapshotInfo := range snapshotsInfo {
+		snapshotsDirs[path.Dir(snapshotInfo.Abspath)] = true
+	}
+	liveFiles := map[string]bool{}
+	for snapshotsDir := range snapshotsDirs {
+		entries, err := os.ReadDir(snapshotsDir)
+		if err != nil {
+			// without knowing which snapshots still exist, no walk is deleted
+			return
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			liveFiles[getScanCacheFile(getFileID(info))] = true
+		}
+	}
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if liveFiles[entry.Name()] || !strings.HasSuffix(entry.Name(), ".gob") {
+			continue
+		}
+		os.Remove(path.Join(cacheDir, entry.Name()))
+	}
+}
@@ -0,0 +1,97 @@
+package snapshots
+
+import (
+	"os"
+	"path"
+	"slices"
+	"snapsync/structs"
+	"testing"
+)
+
+// sizeTestSnapshots creates the snapshots test.0, test.1 and test.2 in snapshotsDir, test.1 sharing
+// shared.txt with test.0.
+func sizeTestSnapshots(t *testing.T, snapshotsDir string) []*structs.SnapshotInfo {
+	t.Helper()
+	writeTestTree(t, snapshotsDir, map[string]string{
+		"test.0/shared.txt": "shared",
+		"test.0/a.txt":      "aa",
+		"test.1/b.txt":      "bbbb",
+		"test.2/c.txt":      "cccccccc",
+	})
+	if err := os.Link(path.Join(snapshotsDir, "test.0/shared.txt"), path.Join(snapshotsDir, "test.1/shared.txt")); err != nil {
+		t.Fatal(err)
+	}
+	snapshotsInfo := []*structs.SnapshotInfo{}
+	for number := 0; number < 3; number++ {
+		snapshotsInfo = append(snapshotsInfo, &structs.SnapshotInfo{
+			SnapshotName: "test",
+			Number:       number,
+			Abspath:      path.Join(snapshotsDir, GetSnapshotDirName("test", number)),
+		})
+	}
+	return snapshotsInfo
+}
+
+func readCacheFiles(t *testing.T, cacheDir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestGetSnapshotsSize(t *testing.T) {
+	snapshotsInfo := sizeTestSnapshots(t, t.TempDir())
+	setSize := GetSnapshotsSize(snapshotsInfo, &SizeOptions{Workers: 2})
+	want := []struct{ apparent, unique, shared int64 }{{8, 2, 6}, {10, 4, 6}, {8, 8, 0}}
+	for i, size := range setSize.Snapshots {
+		if size.Err != nil {
+			t.Fatalf("the size of %d failed: %v", i, size.Err)
+		}
+		if size.Apparent != want[i].apparent || size.Unique != want[i].unique || size.Shared != want[i].shared {
+			t.Errorf("the size of %d is %d apparent, %d unique, %d shared, want %+v", i, size.Apparent, size.Unique, size.Shared, want[i])
+		}
+	}
+	if setSize.DiskUsage != 20 {
+		t.Errorf("DiskUsage = %d, want 20", setSize.DiskUsage)
+	}
+}
+
+func TestGetSnapshotsSizeCache(t *testing.T) {
+	snapshotsDir := t.TempDir()
+	cacheDir := path.Join(snapshotsDir, ".test.sizes")
+	snapshotsInfo := sizeTestSnapshots(t, snapshotsDir)
+	GetSnapshotsSize(snapshotsInfo, &SizeOptions{CacheDir: cacheDir})
+	allCacheFiles := readCacheFiles(t, cacheDir)
+	if len(allCacheFiles) != 3 {
+		t.Fatalf("the cache files are %q, want one for each snapshot", allCacheFiles)
+	}
+
+	// the walks of the snapshots not requested are kept
+	setSize := GetSnapshotsSize(snapshotsInfo[1:2], &SizeOptions{CacheDir: cacheDir})
+	if setSize.Snapshots[0].Apparent != 10 {
+		t.Errorf("the apparent size of 1 is %d, want 10", setSize.Snapshots[0].Apparent)
+	}
+	if cacheFiles := readCacheFiles(t, cacheDir); !slices.Equal(cacheFiles, allCacheFiles) {
+		t.Errorf("the cache files are %q, want %q", cacheFiles, allCacheFiles)
+	}
+
+	// the walks of the deleted snapshots are deleted
+	rootInfo, err := os.Stat(snapshotsInfo[2].Abspath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.RemoveAll(snapshotsInfo[2].Abspath); err != nil {
+		t.Fatal(err)
+	}
+	GetSnapshotsSize(snapshotsInfo[:1], &SizeOptions{CacheDir: cacheDir})
+	cacheFiles := readCacheFiles(t, cacheDir)
+	if len(cacheFiles) != 2 || slices.Contains(cacheFiles, getScanCacheFile(getFileID(rootInfo))) {
+		t.Errorf("the cache files are %q, want the ones of 0 and 1", cacheFiles)
+	}
+}
@@ -1,72 +1,87 @@
 package snapshots
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path"
-	"regexp"
-	"slices"
 	"snapsync/configs"
 	"snapsync/structs"
-	"snapsync/utils"
-	"strconv"
 	"time"
 )
 
-func getRsyncDirsCommand(config *structs.Config, srcDir string, dstDir string, excludes []string) string {
-	rsyncExecutable := "rsync"
-	if len(config.RSyncPath) > 0 {
-		rsyncExecutable = config.RSyncPath
+// executeOnlySnapshot takes the snapshot, writing manifest into it, and returns its path.
+func executeOnlySnapshot(ctx context.Context, config *structs.Config, snapshotConfig *structs.SnapshotConfig, manifest *structs.SnapshotManifest) (snapshotPath string, err error) {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	snapshotTime := time.Now()
+	before := snapshotTime.UnixMilli()
+	err = os.MkdirAll(snapshotConfig.SnapshotsDir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("%s can't create snapshot dir %s: %s", snapshotLogPrefix, snapshotConfig.SnapshotsDir, err.Error())
 	}
-	excludesString := ""
-	if len(excludes) > 0 {
-		for _, exclude := range excludes {
-			excludesString += fmt.Sprintf("%s ", exclude)
-		}
+
+	// repair what a previous interrupted run left behind before starting
+	_, err = recoverSnapshots(snapshotConfig, false)
+	if err != nil {
+		return "", err
 	}
-	return fmt.Sprintf("%s -avrhLK --delete --exclude \"%s\" %s/ %s", rsyncExecutable, excludesString, srcDir, dstDir)
-}
 
-func GetSnapshotDirName(snapshotName string, number int) string {
-	return fmt.Sprintf("%s.%s", snapshotName, strconv.Itoa(number))
-}
+	tmpDir, mkdirErr := os.MkdirTemp(snapshotConfig.SnapshotsDir, getTmpDirPattern(snapshotConfig))
+	if mkdirErr != nil {
+		return "", fmt.Errorf("%s can't create tmp dir %s: %s", snapshotLogPrefix, tmpDir, mkdirErr.Error())
+	}
+	journal := &Journal{
+		SnapshotName: snapshotConfig.SnapshotName,
+		Phase:        JournalPhaseSyncing,
+		Pid:          os.Getpid(),
+		StartedAt:    snapshotTime,
+		TmpDir:       tmpDir,
+	}
 
-func executeOnlySnapshot(config *structs.Config, snapshotConfig *structs.SnapshotConfig) error {
-	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
-	before := time.Now().UnixMilli()
-	newestSnapshotPath := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName(snapshotConfig.SnapshotName, 0))
-	err := os.MkdirAll(snapshotConfig.SnapshotsDir, 0700)
+	// in case of errors be sure to remove the tmp directory to avoid creating junk. Once committing,
+	// the tmp dir and the journal are kept so that the commit can be rolled forward
+	defer func() {
+		if err != nil && journal.Phase == JournalPhaseCommitting {
+			return
+		}
+		os.RemoveAll(tmpDir)
+		removeJournal(snapshotConfig)
+	}()
+	err = writeJournal(snapshotConfig, journal)
 	if err != nil {
-		fmt.Println("hi")
-		return fmt.Errorf("%s can't create snapshot dir %s: %s", snapshotLogPrefix, snapshotConfig.SnapshotsDir, err.Error())
+		return "", fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
 	}
-	tmpDir, mkdirErr := os.MkdirTemp(snapshotConfig.SnapshotsDir, "tmp")
 
-	// in case of errors be sure to remove the tmp directory to avoid creating junk
-	defer os.RemoveAll(tmpDir)
-	if mkdirErr != nil {
-		return fmt.Errorf("%s can't create tmp dir %s: %s", snapshotLogPrefix, tmpDir, mkdirErr.Error())
+	snapshotsInfo, err := ListSnapshots(snapshotConfig)
+	if err != nil {
+		return "", fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
 	}
-	_, err = os.Stat(newestSnapshotPath)
-	// if the snapshot 0 already exists, copy it with hard links into the tmp dir
-	if err == nil {
-		slog.Debug(fmt.Sprintf("%s copying latest snapshot...", snapshotLogPrefix))
-		cpCommand := fmt.Sprintf("%s -lra %s/./ %s", config.CpPath, newestSnapshotPath, tmpDir)
-		slog.Debug(fmt.Sprintf("%s running %s", snapshotLogPrefix, cpCommand))
-		rsyncOutput, cpErr := exec.Command("sh", "-c", cpCommand).CombinedOutput()
-		if cpErr != nil {
-			return fmt.Errorf("%s error copying last snapshot %s to %s: %s, %s", snapshotLogPrefix, newestSnapshotPath, tmpDir, cpErr.Error(), string(rsyncOutput))
+	// if there already is a snapshot, copy the latest one with hard links into the tmp dir
+	if len(snapshotsInfo) > 0 {
+		latestSnapshotPath := snapshotsInfo[0].Abspath
+		slog.Debug(fmt.Sprintf("%s copying latest snapshot %s with %s...", snapshotLogPrefix, latestSnapshotPath, getCloneEngine(config, snapshotConfig)))
+		cloneErrors, cloneErr := cloneSnapshot(ctx, config, snapshotConfig, latestSnapshotPath, tmpDir)
+		for _, cloneError := range cloneErrors {
+			// the sync will copy again what couldn't be linked, so the snapshot is still complete
+			slog.Warn(fmt.Sprintf("%s can't clone %s", snapshotLogPrefix, cloneError.Error()))
+		}
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("%s snapshot interrupted: %w", snapshotLogPrefix, ctx.Err())
+		}
+		if cloneErr != nil {
+			return "", fmt.Errorf("%s error copying last snapshot %s to %s: %s", snapshotLogPrefix, latestSnapshotPath, tmpDir, cloneErr.Error())
 		}
-	} else if os.IsNotExist(err) {
-		slog.Debug(fmt.Sprintf("%s creating first snapshot %s", snapshotLogPrefix, newestSnapshotPath))
 	} else {
-		return fmt.Errorf("%s can't stat %s: %s", newestSnapshotPath, snapshotLogPrefix, err.Error())
+		slog.Debug(fmt.Sprintf("%s creating first snapshot", snapshotLogPrefix))
 	}
-	now := time.Now()
-	os.Chtimes(tmpDir, now, now)
 
+	syncer, err := GetSyncer(config, snapshotConfig)
+	if err != nil {
+		return "", fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	runStats := &RunStats{SnapshotName: snapshotConfig.SnapshotName, SnapshotTime: snapshotTime, Dirs: []*structs.DirSyncStats{}}
+	manifest.SnapshotTime = snapshotTime
 	for _, dirToSnapshot := range snapshotConfig.Dirs {
 		_, err = os.Stat(dirToSnapshot.SrcDirAbspath)
 		if os.IsNotExist(err) {
@@ -78,96 +93,125 @@ func executeOnlySnapshot(config *structs.Config, snapshotConfig *structs.Snapsho
 		if os.IsNotExist(err) {
 			err = os.MkdirAll(dstDirFull, 0700)
 			if err != nil {
-				return fmt.Errorf("%s can't create destination dir %s", snapshotLogPrefix, dstDirFull)
+				return "", fmt.Errorf("%s can't create destination dir %s", snapshotLogPrefix, dstDirFull)
 			}
 		}
-		rsyncCommand := getRsyncDirsCommand(config, dirToSnapshot.SrcDirAbspath, dstDirFull, dirToSnapshot.Excludes)
-		slog.Debug(fmt.Sprintf("%s running %s", snapshotLogPrefix, rsyncCommand))
-		rsyncOutput, err := exec.Command("sh", "-c", rsyncCommand).CombinedOutput()
+		slog.Debug(fmt.Sprintf("%s syncing %s/ to %s", snapshotLogPrefix, dirToSnapshot.SrcDirAbspath, dstDirFull))
+		syncStart := time.Now()
+		var syncStats *structs.SyncStats
+		syncStats, err = syncer.Sync(ctx, dirToSnapshot.SrcDirAbspath, dstDirFull, getSnapshotDirSyncOptions(&dirToSnapshot))
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("%s snapshot interrupted: %w", snapshotLogPrefix, ctx.Err())
+		}
 		if err != nil {
-			return fmt.Errorf("%s can't sync %s/ to %s: %s, %s", snapshotLogPrefix, dirToSnapshot.SrcDirAbspath, dstDirFull, err.Error(), string(rsyncOutput))
+			return "", fmt.Errorf("%s can't sync %s/ to %s: %w", snapshotLogPrefix, dirToSnapshot.SrcDirAbspath, dstDirFull, err)
 		}
+		syncStats.Duration = time.Since(syncStart)
+		runStats.Dirs = append(runStats.Dirs, &structs.DirSyncStats{
+			SrcDirAbspath:    dirToSnapshot.SrcDirAbspath,
+			DstDirInSnapshot: dirToSnapshot.DstDirInSnapshot,
+			SyncStats:        *syncStats,
+		})
+		attrs := append([]any{slog.String("snapshot", snapshotConfig.SnapshotName), slog.String("src_dir", dirToSnapshot.SrcDirAbspath)}, syncStatsAttrs(syncStats)...)
+		slog.Info(fmt.Sprintf("%s synced %s/ to %s", snapshotLogPrefix, dirToSnapshot.SrcDirAbspath, dirToSnapshot.DstDirInSnapshot), attrs...)
 	}
-
-	// rename all the snapshots
-	snapshotsNumbers := []int{}
-	snapshots, err := os.ReadDir(snapshotConfig.SnapshotsDir)
+	if snapshotConfig.Checksums {
+		previousSnapshotPath := ""
+		if len(snapshotsInfo) > 0 {
+			previousSnapshotPath = snapshotsInfo[0].Abspath
+		}
+		var checksums map[string]string
+		var reused int
+		checksums, reused, err = computeChecksums(ctx, tmpDir, previousSnapshotPath)
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("%s snapshot interrupted: %w", snapshotLogPrefix, ctx.Err())
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s can't compute checksums: %s", snapshotLogPrefix, err.Error())
+		}
+		err = writeChecksums(tmpDir, checksums)
+		if err != nil {
+			return "", fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+		}
+		slog.Info(fmt.Sprintf("%s computed the checksums of %d files", snapshotLogPrefix, len(checksums)),
+			slog.String("snapshot", snapshotConfig.SnapshotName), slog.Int("files", len(checksums)), slog.Int("reused", reused))
+	} else {
+		// the checksums cloned from the previous snapshot would be stale
+		os.Remove(path.Join(tmpDir, ChecksumsFileName))
+	}
+	manifest.Dirs = runStats.Dirs
+	err = writeManifest(tmpDir, manifest)
 	if err != nil {
-		return fmt.Errorf("%s can't read directory %s: %s", snapshotLogPrefix, snapshotConfig.SnapshotName, err.Error())
+		return "", fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
 	}
-	snapshotPrefixWithNumberRegex, err := regexp.Compile(fmt.Sprintf("^%s.([0-9]+)$", regexp.QuoteMeta(snapshotConfig.SnapshotName)))
+	// the times are set after syncing, since syncing into the root of the snapshot overwrites them.
+	// With index naming the modification time is the only record of when the snapshot was taken.
+	os.Chtimes(tmpDir, snapshotTime, snapshotTime)
+
+	// the commit only renames, so once started it's not interrupted
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("%s snapshot interrupted: %w", snapshotLogPrefix, ctx.Err())
+	}
+	err = planCommit(snapshotConfig, journal, snapshotTime)
 	if err != nil {
-		return fmt.Errorf("%s error compiling regex: %s", snapshotLogPrefix, err.Error())
+		return "", fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
 	}
-	for _, snapshot := range snapshots {
-		match := snapshotPrefixWithNumberRegex.FindStringSubmatch(snapshot.Name())
-		if match != nil {
-			number, err := strconv.Atoi(match[1]) // match[1] contains the first capturing group
-			if err != nil {
-				return fmt.Errorf("%s error converting string to int: %s", snapshotLogPrefix, err.Error())
-			}
-			snapshotsNumbers = append(snapshotsNumbers, number)
-		}
+	journal.Phase = JournalPhaseCommitting
+	err = writeJournal(snapshotConfig, journal)
+	if err != nil {
+		journal.Phase = JournalPhaseSyncing
+		return "", fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
 	}
-	slices.Sort(snapshotsNumbers)
-	slices.Reverse(snapshotsNumbers)
-	for _, number := range snapshotsNumbers {
-		snapshotOldName := GetSnapshotDirName(snapshotConfig.SnapshotName, number)
-		snapshotOldPath := path.Join(snapshotConfig.SnapshotsDir, snapshotOldName)
-		snapshotRenamedName := GetSnapshotDirName(snapshotConfig.SnapshotName, number+1)
-		snapshotRenamedPath := path.Join(snapshotConfig.SnapshotsDir, snapshotRenamedName)
-		slog.Debug(fmt.Sprintf("%s renaming %s to %s", snapshotLogPrefix, snapshotOldPath, snapshotRenamedName))
-		err = os.Rename(snapshotOldPath, snapshotRenamedPath)
-		if err != nil {
-			return fmt.Errorf("%s can't move %s to %s: %s", snapshotLogPrefix, snapshotOldPath, snapshotOldPath, err.Error())
-		}
+	err = applyCommit(snapshotConfig, journal)
+	if err != nil {
+		return "", err
 	}
-
-	// rename the temporary folder to be the newest snapshot
-	slog.Debug(fmt.Sprintf("%s renaming tmp dir %s to %s", snapshotLogPrefix, tmpDir, newestSnapshotPath))
-	err = os.Rename(tmpDir, newestSnapshotPath)
+	err = removeJournal(snapshotConfig)
 	if err != nil {
-		return fmt.Errorf("%s can't rename temp directory %s to %s: %s", snapshotLogPrefix, tmpDir, newestSnapshotPath, err.Error())
+		return "", fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	runStats.Duration = time.Since(snapshotTime)
+	// the snapshot is complete even if its stats can't be saved
+	if statsErr := appendRunStats(snapshotConfig, runStats); statsErr != nil {
+		slog.Warn(fmt.Sprintf("%s %s", snapshotLogPrefix, statsErr.Error()))
 	}
 
-	// delete the excess amount of snapshots
-	snapshots, err = os.ReadDir(snapshotConfig.SnapshotsDir)
+	// delete the snapshots not kept by the retention policy
+	_, err = pruneSnapshots(snapshotConfig, GetRetentionPolicy(snapshotConfig), false)
 	if err != nil {
-		return fmt.Errorf("%s can't read directory %s: %s", snapshotLogPrefix, snapshotConfig.SnapshotsDir, err.Error())
-	}
-	for _, snapshotEntry := range snapshots {
-		snapshotInfo, err := utils.GetInfoFromSnapshotPath(snapshotEntry.Name())
-		if err != nil {
-			return err
-		}
-		if snapshotInfo.Number >= snapshotConfig.Retention {
-			snapshotToRemoveName := GetSnapshotDirName(snapshotConfig.SnapshotName, snapshotInfo.Number)
-			snapshotToRemovePath := path.Join(snapshotConfig.SnapshotsDir, snapshotToRemoveName)
-			slog.Debug(fmt.Sprintf("removing %s", snapshotToRemovePath))
-			err = os.RemoveAll(snapshotToRemovePath)
-			if err != nil {
-				return fmt.Errorf("%s can't remove snapshot %s: %s", snapshotLogPrefix, snapshotToRemovePath, err.Error())
-			}
-		}
+		return "", err
 	}
 
 	after := time.Now().UnixMilli()
 	seconds := float64(after-before) / 1000
-	slog.Info(fmt.Sprintf("%s snapshots done in %.2f s", snapshotLogPrefix, seconds))
-	return nil
+	attrs := append([]any{slog.String("snapshot", snapshotConfig.SnapshotName)}, syncStatsAttrs(runStats.Total())...)
+	slog.Info(fmt.Sprintf("%s snapshots done in %.2f s", snapshotLogPrefix, seconds), attrs...)
+	return journal.SnapshotPath, nil
 }
 
-func ExecuteSnapshot(config *structs.Config, snapshotConfig *structs.SnapshotConfig) error {
+// ExecuteSnapshot runs the pre snapshot commands, takes the snapshot and runs the post snapshot
+// commands. When ctx is done the commands being run are stopped, the tmp dir is deleted and the
+// returned error wraps the error of ctx.
+func ExecuteSnapshot(ctx context.Context, config *structs.Config, snapshotConfig *structs.SnapshotConfig) error {
 	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
-	before := time.Now().UnixMilli()
+	// the lock is held while running the hooks too, since they usually prepare the sources
+	lock, err := acquireSnapshotLock(ctx, snapshotConfig, "snapshot")
+	if err != nil {
+		return fmt.Errorf("%s %w", snapshotLogPrefix, err)
+	}
+	defer lock.Release()
+	manifest := newManifest(snapshotConfig)
+	before := manifest.StartedAt.UnixMilli()
 	if len(snapshotConfig.PreSnapshotCommands) > 0 {
 		slog.Info(fmt.Sprintf("%s executing pre snapshot commands", snapshotLogPrefix))
 		for _, command := range snapshotConfig.PreSnapshotCommands {
 			slog.Info(snapshotLogPrefix + " " + command)
-			result, err := exec.Command("sh", "-c", command).Output()
+			result, err := runHook(ctx, manifest, hookPhasePre, command)
+			if ctx.Err() != nil {
+				return fmt.Errorf("%s pre snapshot commands interrupted: %w", snapshotLogPrefix, ctx.Err())
+			}
 			if err != nil {
-				fmt.Println(snapshotLogPrefix + command + ": " + err.Error())
-				return err
+				return fmt.Errorf("%s %w", snapshotLogPrefix, err)
 			}
 			if len(result) > 0 {
 				slog.Info(snapshotLogPrefix + command + ": " + string(result))
@@ -180,86 +224,70 @@ func ExecuteSnapshot(config *structs.Config, snapshotConfig *structs.SnapshotCon
 		slog.Info(fmt.Sprintf("%s no pre snapshot commands to run", snapshotLogPrefix))
 	}
 
-	err := executeOnlySnapshot(config, snapshotConfig)
-	if err != nil {
+	snapshotPath, snapshotErr := executeOnlySnapshot(ctx, config, snapshotConfig, manifest)
+	if snapshotErr != nil {
 		if !snapshotConfig.AlwaysRunPostSnapshotCommands {
-			return err
+			return snapshotErr
 		}
-		slog.Error(err.Error())
+		slog.Error(snapshotErr.Error())
 	}
 
+	// the post snapshot commands usually undo what the pre snapshot commands did, like restarting a
+	// service, so after an interruption they are still given some time to run
+	postCtx := ctx
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		postCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), commandStopTimeout)
+		defer cancel()
+	}
+	var postErr error
 	if len(snapshotConfig.PostSnapshotCommands) > 0 {
 		slog.Info(fmt.Sprintf("%s executing post snapshot commands", snapshotLogPrefix))
 		for _, command := range snapshotConfig.PostSnapshotCommands {
 			slog.Info(fmt.Sprintf("%s %s", snapshotLogPrefix, command))
-			result, err := exec.Command("sh", "-c", command).Output()
+			result, err := runHook(postCtx, manifest, hookPhasePost, command)
 			if err != nil {
-				return fmt.Errorf("%s %s: %s", snapshotLogPrefix, command, err.Error())
+				postErr = fmt.Errorf("%s %w", snapshotLogPrefix, err)
+				break
 			}
 			if len(result) > 0 {
 				slog.Info(snapshotLogPrefix + command + ": " + string(result))
 			}
 		}
-		after := time.Now().UnixMilli()
-		seconds := float64(after-before) / 1000
-		slog.Info(fmt.Sprintf("%s post snapshot commands done in %.2f s", snapshotLogPrefix, seconds))
+		if postErr == nil {
+			after := time.Now().UnixMilli()
+			seconds := float64(after-before) / 1000
+			slog.Info(fmt.Sprintf("%s post snapshot commands done in %.2f s", snapshotLogPrefix, seconds))
+		}
 	} else {
 		slog.Info(fmt.Sprintf("%s no post snapshot commands to run", snapshotLogPrefix))
 	}
 
-	now := time.Now()
-	os.Chtimes(GetSnapshotDirName(snapshotConfig.SnapshotName, 0), now, now)
-	return nil
+	// the snapshot was taken only if there was no error
+	if snapshotErr == nil {
+		err = finishManifest(snapshotPath, manifest, postErr)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("%s %s", snapshotLogPrefix, err.Error()))
+		}
+	}
+	if postErr != nil {
+		return postErr
+	}
+	// a failed or interrupted snapshot is reported even if the post snapshot commands ran
+	return snapshotErr
 }
 
 func GetSnapshotsInfo(snapshotsConfigsDir string, expandVars bool, snapshotName string) (snapshotsInfo []*structs.SnapshotInfo, err error) {
 	snapshotConfig, err := configs.GetSnapshotConfigByName(snapshotsConfigsDir, expandVars, snapshotName)
 	if err != nil {
-		return snapshotsInfo, fmt.Errorf("can't list snapshots of %s: %s", snapshotName, err.Error())
-	}
-	if snapshotConfig == nil {
-		slog.Warn("Snapshot template " + snapshotName + " does not exist.")
-		return snapshotsInfo, nil
+		return snapshotsInfo, fmt.Errorf("can't list snapshots of %s: %w", snapshotName, err)
 	}
-	_, err = os.Stat(snapshotConfig.SnapshotsDir)
-	if os.IsNotExist(err) {
-		slog.Info("No snapshots found for " + snapshotName)
-		return snapshotsInfo, nil
-	}
-	snapshotsDirsEntries, err := os.ReadDir(snapshotConfig.SnapshotsDir)
+	snapshotsInfo, err = ListSnapshots(snapshotConfig)
 	if err != nil {
 		return snapshotsInfo, fmt.Errorf("can't list snapshot of %s: %s", snapshotName, err.Error())
 	}
-	for _, entry := range snapshotsDirsEntries {
-		snapshotFullPath := path.Join(snapshotConfig.SnapshotsDir, entry.Name())
-		_, err := os.Stat(snapshotFullPath)
-		if err != nil {
-			return snapshotsInfo, fmt.Errorf("can't stat %s: %s", snapshotFullPath, err.Error())
-		}
-		snapshotInfo, err := utils.GetInfoFromSnapshotPath(path.Join(snapshotConfig.SnapshotsDir, entry.Name()))
-		if err != nil {
-			return snapshotsInfo, fmt.Errorf("can't parse snapshot name: %s", err.Error())
-		}
-		snapshotsInfo = append(snapshotsInfo, snapshotInfo)
+	if len(snapshotsInfo) == 0 {
+		slog.Info("No snapshots found for " + snapshotName)
 	}
 	return snapshotsInfo, nil
 }
-
-func RestoreSnapshot(config *structs.Config, number int, snapshotConfig *structs.SnapshotConfig) (err error) {
-	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
-	for _, dir := range snapshotConfig.Dirs {
-		err = os.MkdirAll(dir.SrcDirAbspath, 0700)
-		if err != nil {
-			return fmt.Errorf("can't create directory %s: %s", dir.SrcDirAbspath, err.Error())
-		}
-
-		snapshottedDirPath := path.Join(snapshotConfig.SnapshotsDir, fmt.Sprintf("%s.%d", snapshotConfig.SnapshotName, number), dir.DstDirInSnapshot)
-		rsyncCommand := getRsyncDirsCommand(config, snapshottedDirPath, dir.SrcDirAbspath, nil)
-		slog.Debug(rsyncCommand)
-		_, err = exec.Command("sh", "-c", rsyncCommand).Output()
-		if err != nil {
-			slog.Error(fmt.Sprintf("%s can't sync %s/ to %s: %s", snapshotLogPrefix, snapshottedDirPath, dir.SrcDirAbspath, err.Error()))
-		}
-	}
-	return err
-}
@@ -0,0 +1,87 @@
+package snapshots
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"snapsync/structs"
+	"time"
+)
+
+// RunStats are the changes made by a snapshot run. The runs are appended to the stats file of the
+// snapshots dir, that outlives the snapshots deleted by the retention policy.
+type RunStats struct {
+	SnapshotName string `json:"snapshot_name"`
+	// SnapshotTime identifies the snapshot taken, since with index naming its name changes
+	SnapshotTime time.Time `json:"snapshot_time"`
+	// Duration is in nanoseconds in JSON, and includes cloning the previous snapshot
+	Duration time.Duration           `json:"duration"`
+	Dirs     []*structs.DirSyncStats `json:"dirs"`
+}
+
+// Total sums the stats of all the dirs of the run.
+func (runStats *RunStats) Total() *structs.SyncStats {
+	total := &structs.SyncStats{Duration: runStats.Duration}
+	for _, dirStats := range runStats.Dirs {
+		total.FilesTransferred += dirStats.FilesTransferred
+		total.FilesDeleted += dirStats.FilesDeleted
+		total.BytesTransferred += dirStats.BytesTransferred
+		total.SnapshotBytes += dirStats.SnapshotBytes
+	}
+	return total
+}
+
+func GetStatsPath(snapshotConfig *structs.SnapshotConfig) string {
+	return path.Join(snapshotConfig.SnapshotsDir, fmt.Sprintf(".%s.stats.jsonl", snapshotConfig.SnapshotName))
+}
+
+// appendRunStats adds the stats of a run to the stats file, one JSON object per line.
+func appendRunStats(snapshotConfig *structs.SnapshotConfig, runStats *RunStats) error {
+	content, err := json.Marshal(runStats)
+	if err != nil {
+		return fmt.Errorf("can't encode stats: %s", err.Error())
+	}
+	statsPath := GetStatsPath(snapshotConfig)
+	file, err := os.OpenFile(statsPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("can't write stats %s: %s", statsPath, err.Error())
+	}
+	_, err = file.Write(append(content, '\n'))
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("can't write stats %s: %s", statsPath, err.Error())
+	}
+	return nil
+}
+
+// ReadRunStats returns the stats of the past runs of snapshotConfig, from the oldest. The lines that
+// can't be parsed, like one truncated by a crash, are skipped.
+func ReadRunStats(snapshotConfig *structs.SnapshotConfig) ([]*RunStats, error) {
+	file, err := os.Open(GetStatsPath(snapshotConfig))
+	if os.IsNotExist(err) {
+		return []*RunStats{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	runsStats := []*RunStats{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		runStats := &RunStats{}
+		if json.Unmarshal(scanner.Bytes(), runStats) != nil {
+			continue
+		}
+		runsStats = append(runsStats, runStats)
+	}
+	if err = scanner.Err(); err != nil {
+		return runsStats, fmt.Errorf("can't read stats %s: %s", GetStatsPath(snapshotConfig), err.Error())
+	}
+	return runsStats, nil
+}
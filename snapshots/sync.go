@@ -0,0 +1,179 @@
+package snapshots
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"snapsync/structs"
+	"strconv"
+	"strings"
+)
+
+// SyncOptions are the options of a single sync between two directories.
+type SyncOptions struct {
+	Includes    []string
+	Excludes    []string
+	ExcludeFrom []string
+	Filters     []string
+}
+
+func getSnapshotDirSyncOptions(snapshotDir *structs.SnapshotDir) *SyncOptions {
+	return &SyncOptions{
+		Includes:    snapshotDir.Includes,
+		Excludes:    snapshotDir.Excludes,
+		ExcludeFrom: snapshotDir.ExcludeFrom,
+		Filters:     snapshotDir.Filters,
+	}
+}
+
+// syncStatsAttrs returns the stats as slog attributes.
+func syncStatsAttrs(stats *structs.SyncStats) []any {
+	return []any{
+		slog.Int64("files_transferred", stats.FilesTransferred),
+		slog.Int64("files_deleted", stats.FilesDeleted),
+		slog.Int64("bytes_transferred", stats.BytesTransferred),
+		slog.Int64("snapshot_bytes", stats.SnapshotBytes),
+		slog.Duration("duration", stats.Duration),
+	}
+}
+
+// Syncer makes a destination directory a mirror of a source directory, rewriting only what changed
+// and deleting what doesn't exist anymore in the source. The sync stops early when ctx is done.
+// Sync returns the changes it made, except their duration that is measured by the caller.
+type Syncer interface {
+	Sync(ctx context.Context, srcDir string, dstDir string, options *SyncOptions) (*structs.SyncStats, error)
+}
+
+// SyncError is returned by the syncers when a sync fails. Stderr is what the sync engine printed,
+// like the files that rsync couldn't transfer.
+type SyncError struct {
+	Command string
+	Err     error
+	Stderr  string
+}
+
+func (syncErr *SyncError) Error() string {
+	message := fmt.Sprintf("%s: %s", syncErr.Command, syncErr.Err.Error())
+	if len(syncErr.Stderr) > 0 {
+		message += ", " + syncErr.Stderr
+	}
+	return message
+}
+
+func (syncErr *SyncError) Unwrap() error {
+	return syncErr.Err
+}
+
+// RsyncSyncer syncs the directories running the rsync executable.
+type RsyncSyncer struct {
+	Config   *structs.Config
+	Checksum bool
+}
+
+func (syncer *RsyncSyncer) Sync(ctx context.Context, srcDir string, dstDir string, options *SyncOptions) (*structs.SyncStats, error) {
+	rsyncCommand := newCommand(ctx, getRsyncExecutable(syncer.Config), getRsyncArgs(srcDir, dstDir, options, syncer.Checksum)...)
+	slog.Debug(fmt.Sprintf("running %s", rsyncCommand.String()))
+	var rsyncStderr bytes.Buffer
+	rsyncCommand.Stderr = &rsyncStderr
+	rsyncOutput, err := rsyncCommand.Output()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, &SyncError{Command: rsyncCommand.String(), Err: err, Stderr: strings.TrimSpace(rsyncStderr.String())}
+	}
+	return parseRsyncStats(string(rsyncOutput)), nil
+}
+
+var rsyncStatRegex = regexp.MustCompile(`^([A-Za-z ]+): ([0-9,]+)`)
+
+// parseRsyncStats reads the stats from the output of rsync --stats --itemize-changes. The rsync
+// versions before 3.1 don't count the deleted files, so they are counted from the itemized changes.
+func parseRsyncStats(output string) *structs.SyncStats {
+	stats := &structs.SyncStats{}
+	itemizedDeletions := int64(0)
+	deletedFilesFound := false
+	regularFilesFound := false
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "*deleting ") {
+			itemizedDeletions++
+			continue
+		}
+		match := rsyncStatRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		value, err := strconv.ParseInt(strings.ReplaceAll(match[2], ",", ""), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch match[1] {
+		case "Number of regular files transferred":
+			stats.FilesTransferred = value
+			regularFilesFound = true
+		case "Number of files transferred":
+			// the older versions count the directories too
+			if !regularFilesFound {
+				stats.FilesTransferred = value
+			}
+		case "Number of deleted files":
+			stats.FilesDeleted = value
+			deletedFilesFound = true
+		case "Total file size":
+			stats.SnapshotBytes = value
+		case "Total transferred file size":
+			stats.BytesTransferred = value
+		}
+	}
+	if !deletedFilesFound {
+		stats.FilesDeleted = itemizedDeletions
+	}
+	return stats
+}
+
+// GetSyncer returns the Syncer chosen by the snapshot config, rsync by default.
+func GetSyncer(config *structs.Config, snapshotConfig *structs.SnapshotConfig) (Syncer, error) {
+	switch snapshotConfig.SyncEngine {
+	case "", structs.SyncEngineRsync:
+		return &RsyncSyncer{Config: config, Checksum: snapshotConfig.SyncChecksum}, nil
+	case structs.SyncEngineNative:
+		return &NativeSyncer{Checksum: snapshotConfig.SyncChecksum}, nil
+	default:
+		return nil, fmt.Errorf("unknown sync engine %s", snapshotConfig.SyncEngine)
+	}
+}
+
+// getRsyncArgs returns the arguments of the rsync invocation that syncs srcDir into dstDir. The rules
+// are passed in the order rsync evaluates them, so that the first matching rule wins: filters
+// first, then includes, so that they can re-include something excluded later, then excludes.
+func getRsyncArgs(srcDir string, dstDir string, options *SyncOptions, checksum bool) []string {
+	// the sizes are not human readable so that the stats can be parsed
+	flags := "-avrLK"
+	if checksum {
+		flags += "c"
+	}
+	args := []string{flags, "--delete", "--stats", "--itemize-changes"}
+	for _, filter := range options.Filters {
+		args = append(args, "--filter="+filter)
+	}
+	for _, include := range options.Includes {
+		args = append(args, "--include="+include)
+	}
+	for _, exclude := range options.Excludes {
+		args = append(args, "--exclude="+exclude)
+	}
+	for _, excludeFrom := range options.ExcludeFrom {
+		args = append(args, "--exclude-from="+excludeFrom)
+	}
+	// after -- a path starting with a dash is not taken for an option
+	return append(args, "--", strings.TrimSuffix(srcDir, "/")+"/", dstDir)
+}
+
+func getRsyncExecutable(config *structs.Config) string {
+	if len(config.RSyncPath) > 0 {
+		return config.RSyncPath
+	}
+	return "rsync"
+}
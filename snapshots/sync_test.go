@@ -0,0 +1,104 @@
+package snapshots
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestGetRsyncArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		srcDir   string
+		dstDir   string
+		options  *SyncOptions
+		checksum bool
+		want     []string
+	}{
+		{
+			name:    "plain paths",
+			srcDir:  "/home/user",
+			dstDir:  "/snapshots/tmp/home",
+			options: &SyncOptions{},
+			want:    []string{"-avrLK", "--delete", "--stats", "--itemize-changes", "--", "/home/user/", "/snapshots/tmp/home"},
+		},
+		{
+			name:     "checksum",
+			srcDir:   "/src",
+			dstDir:   "/dst",
+			options:  &SyncOptions{},
+			checksum: true,
+			want:     []string{"-avrLKc", "--delete", "--stats", "--itemize-changes", "--", "/src/", "/dst"},
+		},
+		{
+			name:    "trailing slash is not doubled",
+			srcDir:  "/home/user/",
+			dstDir:  "/dst/",
+			options: &SyncOptions{},
+			want:    []string{"-avrLK", "--delete", "--stats", "--itemize-changes", "--", "/home/user/", "/dst/"},
+		},
+		{
+			name:    "spaces",
+			srcDir:  "/home/my user/My Documents",
+			dstDir:  "/snap shots/tmp dir",
+			options: &SyncOptions{},
+			want:    []string{"-avrLK", "--delete", "--stats", "--itemize-changes", "--", "/home/my user/My Documents/", "/snap shots/tmp dir"},
+		},
+		{
+			name:    "quotes",
+			srcDir:  `/home/it's "quoted"`,
+			dstDir:  `/dst/'single' "double"`,
+			options: &SyncOptions{},
+			want:    []string{"-avrLK", "--delete", "--stats", "--itemize-changes", "--", `/home/it's "quoted"/`, `/dst/'single' "double"`},
+		},
+		{
+			name:    "shell expansions",
+			srcDir:  "/home/$USER/`id`/$(rm -rf x)",
+			dstDir:  "/dst/${HOME};*",
+			options: &SyncOptions{},
+			want:    []string{"-avrLK", "--delete", "--stats", "--itemize-changes", "--", "/home/$USER/`id`/$(rm -rf x)/", "/dst/${HOME};*"},
+		},
+		{
+			name:    "leading dash",
+			srcDir:  "-src",
+			dstDir:  "--dst",
+			options: &SyncOptions{},
+			want:    []string{"-avrLK", "--delete", "--stats", "--itemize-changes", "--", "-src/", "--dst"},
+		},
+		{
+			name:   "rules order",
+			srcDir: "/src",
+			dstDir: "/dst",
+			options: &SyncOptions{
+				Includes:    []string{"keep.log", "/docs/"},
+				Excludes:    []string{"*.log", "node_modules/"},
+				ExcludeFrom: []string{"/etc/snapsync/excludes"},
+				Filters:     []string{"- *.tmp", "+ important.tmp"},
+			},
+			want: []string{"-avrLK", "--delete", "--stats", "--itemize-changes",
+				"--filter=- *.tmp", "--filter=+ important.tmp",
+				"--include=keep.log", "--include=/docs/",
+				"--exclude=*.log", "--exclude=node_modules/",
+				"--exclude-from=/etc/snapsync/excludes",
+				"--", "/src/", "/dst"},
+		},
+		{
+			name:   "patterns with spaces and quotes",
+			srcDir: "/src",
+			dstDir: "/dst",
+			options: &SyncOptions{
+				Excludes:    []string{"My Cache/", `it's "here"`, "$HOME"},
+				ExcludeFrom: []string{"/etc/my excludes"},
+			},
+			want: []string{"-avrLK", "--delete", "--stats", "--itemize-changes",
+				"--exclude=My Cache/", `--exclude=it's "here"`, "--exclude=$HOME",
+				"--exclude-from=/etc/my excludes",
+				"--", "/src/", "/dst"},
+		},
+	}
+	for _, test := range tests {
+		got := getRsyncArgs(test.srcDir, test.dstDir, test.options, test.checksum)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: getRsyncArgs(%q, %q) =\n%q\nwant\n%q", test.name, test.srcDir, test.dstDir, got, test.want)
+		}
+	}
+}
@@ -1,54 +1,198 @@
 package structs
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
-	"path/filepath"
+	"path"
+	"time"
+)
+
+// SnapshotTimeLayout is the layout of the time in the name of the snapshots with timestamp naming.
+// It doesn't contain dots or colons so that it can be used in a file name.
+const SnapshotTimeLayout = "2006-01-02T15-04-05Z"
+
+// PreRestoreSelector selects the safety snapshots taken before restoring, named
+// <name>.pre-restore.<timestamp>, or <name>.pre-restore.<timestamp>-<index> when more of them are
+// taken in the same second.
+const PreRestoreSelector = "pre-restore"
+
+// ManifestFileName is the name of the manifest in the root of each snapshot.
+const ManifestFileName = ".snapsync.json"
+
+const (
+	// ManifestStatusCommitted means that the snapshot was taken, but the post snapshot commands didn't
+	// complete yet, or the run was killed before they did
+	ManifestStatusCommitted = "committed"
+	ManifestStatusSuccess   = "success"
+	// ManifestStatusFailed means that the snapshot was taken, but the post snapshot commands failed
+	ManifestStatusFailed = "failed"
 )
 
 type Config struct {
-	LogLevel            string `yaml:"log_level"`
-	CpPath              string `yaml:"cp_path"`
-	RSyncPath           string `yaml:"rsync_path"`
-	SnapshotsConfigsDir string `yaml:"snapshots_configs_dir"`
+	LogLevel                     string `yaml:"log_level"`
+	CpPath                       string `yaml:"cp_path"`
+	RSyncPath                    string `yaml:"rsync_path"`
+	SnapshotsConfigsDir          string `yaml:"snapshots_configs_dir"`
+	ShutdownGracePeriod          string `yaml:"shutdown_grace_period"`
+	SnapshotsConfigsPollInterval string `yaml:"snapshots_configs_poll_interval"`
 }
 
 type SnapshotConfig struct {
-	SnapshotName                  string        `yaml:"snapshot_name"`
-	Dirs                          []SnapshotDir `yaml:"dirs"`
-	SnapshotsDir                  string        `yaml:"snapshots_dir"`
-	Retention                     int           `yaml:"retention"`
-	Cron                          string        `yaml:"cron"`
-	AlwaysRunPostSnapshotCommands bool          `yaml:"always_run_post_snapshot_commands"`
-	PreSnapshotCommands           []string      `yaml:"pre_snapshot_commands"`
-	PostSnapshotCommands          []string      `yaml:"post_snapshot_commands"`
+	SnapshotName                  string           `yaml:"snapshot_name" json:"snapshot_name,omitempty"`
+	Dirs                          []SnapshotDir    `yaml:"dirs" json:"dirs,omitempty"`
+	SnapshotsDir                  string           `yaml:"snapshots_dir" json:"snapshots_dir,omitempty"`
+	Retention                     int              `yaml:"retention" json:"retention,omitempty"`
+	RetentionPolicy               *RetentionPolicy `yaml:"retention_policy" json:"retention_policy,omitempty"`
+	Cron                          string           `yaml:"cron" json:"cron,omitempty"`
+	AlwaysRunPostSnapshotCommands bool             `yaml:"always_run_post_snapshot_commands" json:"always_run_post_snapshot_commands,omitempty"`
+	PreSnapshotCommands           []string         `yaml:"pre_snapshot_commands" json:"pre_snapshot_commands,omitempty"`
+	PostSnapshotCommands          []string         `yaml:"post_snapshot_commands" json:"post_snapshot_commands,omitempty"`
+	LockPolicy                    string           `yaml:"lock_policy" json:"lock_policy,omitempty"`
+	LockTimeout                   string           `yaml:"lock_timeout" json:"lock_timeout,omitempty"`
+	CloneEngine                   string           `yaml:"clone_engine" json:"clone_engine,omitempty"`
+	Naming                        string           `yaml:"naming" json:"naming,omitempty"`
+	SyncEngine                    string           `yaml:"sync_engine" json:"sync_engine,omitempty"`
+	SyncChecksum                  bool             `yaml:"sync_checksum" json:"sync_checksum,omitempty"`
+	Checksums                     bool             `yaml:"checksums" json:"checksums,omitempty"`
+}
+
+// The values of the lock_policy, clone_engine, naming and sync_engine fields of SnapshotConfig.
+const (
+	// LockPolicySkip gives up immediately if another run holds the lock
+	LockPolicySkip = "skip"
+	// LockPolicyQueue waits for the other run to release the lock, without a timeout
+	LockPolicyQueue = "queue"
+	// LockPolicyWait waits for the other run to release the lock, up to lock_timeout
+	LockPolicyWait = "wait"
+
+	CloneEngineCp     = "cp"
+	CloneEngineNative = "native"
+
+	NamingIndex     = "index"
+	NamingTimestamp = "timestamp"
+
+	SyncEngineRsync  = "rsync"
+	SyncEngineNative = "native"
+)
+
+var (
+	LockPolicies = []string{LockPolicySkip, LockPolicyQueue, LockPolicyWait}
+	CloneEngines = []string{CloneEngineCp, CloneEngineNative}
+	Namings      = []string{NamingIndex, NamingTimestamp}
+	SyncEngines  = []string{SyncEngineRsync, SyncEngineNative}
+)
+
+// RetentionPolicy tells which snapshots to keep. A snapshot is kept if any of the rules keeps it.
+type RetentionPolicy struct {
+	KeepLast    int    `yaml:"keep_last" json:"keep_last,omitempty"`
+	KeepHourly  int    `yaml:"keep_hourly" json:"keep_hourly,omitempty"`
+	KeepDaily   int    `yaml:"keep_daily" json:"keep_daily,omitempty"`
+	KeepWeekly  int    `yaml:"keep_weekly" json:"keep_weekly,omitempty"`
+	KeepMonthly int    `yaml:"keep_monthly" json:"keep_monthly,omitempty"`
+	KeepYearly  int    `yaml:"keep_yearly" json:"keep_yearly,omitempty"`
+	KeepWithin  string `yaml:"keep_within" json:"keep_within,omitempty"`
 }
 
 type SnapshotDir struct {
-	SrcDirAbspath    string   `yaml:"src_dir_abspath"`
-	DstDirInSnapshot string   `yaml:"dst_dir_in_snapshot"`
-	Excludes         []string `yaml:"excludes"`
+	SrcDirAbspath    string   `yaml:"src_dir_abspath" json:"src_dir_abspath,omitempty"`
+	DstDirInSnapshot string   `yaml:"dst_dir_in_snapshot" json:"dst_dir_in_snapshot,omitempty"`
+	Includes         []string `yaml:"includes" json:"includes,omitempty"`
+	Excludes         []string `yaml:"excludes" json:"excludes,omitempty"`
+	ExcludeFrom      []string `yaml:"exclude_from" json:"exclude_from,omitempty"`
+	Filters          []string `yaml:"filters" json:"filters,omitempty"`
+}
+
+// SyncStats are the changes made by a sync.
+type SyncStats struct {
+	// FilesTransferred is the number of files copied because they were new or changed
+	FilesTransferred int64 `json:"files_transferred"`
+	// FilesDeleted is the number of entries deleted because they don't exist anymore in the source
+	FilesDeleted     int64 `json:"files_deleted"`
+	BytesTransferred int64 `json:"bytes_transferred"`
+	// SnapshotBytes is the size of all the files of the destination after the sync
+	SnapshotBytes int64 `json:"snapshot_bytes"`
+	// Duration is in nanoseconds in JSON
+	Duration time.Duration `json:"duration"`
+}
+
+// DirSyncStats are the changes made syncing a SnapshotDir.
+type DirSyncStats struct {
+	SrcDirAbspath    string `json:"src_dir_abspath"`
+	DstDirInSnapshot string `json:"dst_dir_in_snapshot"`
+	SyncStats
+}
+
+// HookResult is the outcome of a pre or post snapshot command.
+type HookResult struct {
+	Phase    string        `json:"phase"`
+	Command  string        `json:"command"`
+	ExitCode int           `json:"exit_code"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// SnapshotManifest tells how and when a snapshot was taken. It's saved as ManifestFileName in the root
+// of the snapshot.
+type SnapshotManifest struct {
+	SnapshotName    string `json:"snapshot_name"`
+	SnapsyncVersion string `json:"snapsync_version"`
+	Host            string `json:"host"`
+	// StartedAt is when the pre snapshot commands started
+	StartedAt time.Time `json:"started_at"`
+	// SnapshotTime is when the sync started, that is the time of the snapshot
+	SnapshotTime time.Time `json:"snapshot_time"`
+	// FinishedAt is when the post snapshot commands ended, zero while the status is committed
+	FinishedAt time.Time       `json:"finished_at"`
+	Status     string          `json:"status"`
+	Error      string          `json:"error,omitempty"`
+	Config     *SnapshotConfig `json:"config"`
+	Dirs       []*DirSyncStats `json:"dirs"`
+	Hooks      []*HookResult   `json:"hooks"`
 }
 
 type SnapshotInfo struct {
 	Abspath      string
 	SnapshotName string
-	Number       int
+	// Number is the position of the snapshot with index naming, or -1 with timestamp naming
+	Number int
+	// Time is when the snapshot was taken, that is parsed from the name with timestamp naming
+	Time        time.Time
+	Timestamped bool
+	// PreRestore is set for the safety snapshots taken before restoring, that are not part of the
+	// snapshots of the config
+	PreRestore bool
+	// Manifest is nil until loaded by LoadManifest, and for the snapshots taken without one
+	Manifest *SnapshotManifest
 }
 
-func (snapshotInfo *SnapshotInfo) CompactName() string {
-	return fmt.Sprintf("%s.%d", snapshotInfo.SnapshotName, snapshotInfo.Number)
+// LoadManifest reads the manifest of the snapshot into Manifest. A snapshot taken before the manifests
+// were introduced isn't an error, and leaves Manifest nil.
+func (snapshotInfo *SnapshotInfo) LoadManifest() error {
+	content, err := os.ReadFile(path.Join(snapshotInfo.Abspath, ManifestFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't read manifest of %s: %s", snapshotInfo.CompactName(), err.Error())
+	}
+	manifest := &SnapshotManifest{}
+	err = json.Unmarshal(content, manifest)
+	if err != nil {
+		return fmt.Errorf("can't parse manifest of %s: %s", snapshotInfo.CompactName(), err.Error())
+	}
+	snapshotInfo.Manifest = manifest
+	return nil
 }
 
-func (snapshotInfo *SnapshotInfo) Size() (size int64, err error) {
-	err = filepath.Walk(snapshotInfo.Abspath, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			size += info.Size()
-		}
-		return nil
-	})
-	return size, err
+func (snapshotInfo *SnapshotInfo) CompactName() string {
+	// the name of a safety snapshot can have a suffix that tells it apart from the others taken in
+	// the same second
+	if snapshotInfo.PreRestore {
+		return path.Base(snapshotInfo.Abspath)
+	}
+	if snapshotInfo.Timestamped {
+		return fmt.Sprintf("%s.%s", snapshotInfo.SnapshotName, snapshotInfo.Time.UTC().Format(SnapshotTimeLayout))
+	}
+	return fmt.Sprintf("%s.%d", snapshotInfo.SnapshotName, snapshotInfo.Number)
 }
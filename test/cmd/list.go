@@ -41,15 +41,14 @@ var listCmd = &cobra.Command{
 			slog.Error("Can't get snapshots of snapshot " + snapshotToList + ": " + err.Error())
 			return
 		}
-		for _, snapshotInfo := range snapshotsInfo {
-			size, err := snapshotInfo.Size()
+		for _, size := range snapshots.GetSnapshotsSize(snapshotsInfo, &snapshots.SizeOptions{}).Snapshots {
 			sizeStr := ""
-			if err != nil {
-				sizeStr = fmt.Sprintf("can't evaluate snapshot size: %s", err.Error())
+			if size.Err != nil {
+				sizeStr = fmt.Sprintf("can't evaluate snapshot size: %s", size.Err.Error())
 			} else {
-				sizeStr = utils.HumanReadableSize(size)
+				sizeStr = utils.HumanReadableSize(size.Unique)
 			}
-			fmt.Printf("%s, size: %s\n", snapshotInfo.CompactName(), sizeStr)
+			fmt.Printf("%s, size: %s\n", size.Snapshot.CompactName(), sizeStr)
 		}
 	},
 }
@@ -6,9 +6,12 @@ package cmd
 import (
 	"fmt"
 	"log/slog"
+	"os"
+	"os/signal"
 	"snapsync/configs"
 	"snapsync/snapshots"
 	"snapsync/utils"
+	"syscall"
 
 	"github.com/spf13/cobra"
 )
@@ -38,7 +41,7 @@ var restoreCmd = &cobra.Command{
 
 		snapshotToRestore := args[0]
 
-		snapshotName, number, err := utils.GetInfoFromSnapshotBasePath(snapshotToRestore)
+		snapshotName, selector, err := utils.SplitSnapshotId(snapshotToRestore)
 		if err != nil {
 			slog.Error(fmt.Sprintf("can't get snapshot info: %s", err.Error()))
 			return
@@ -50,7 +53,16 @@ var restoreCmd = &cobra.Command{
 			return
 		}
 
-		err = snapshots.RestoreSnapshot(config, number, snapshotConfig)
+		snapshotInfo, err := snapshots.GetSnapshotInfo(snapshotConfig, selector)
+		if err != nil {
+			slog.Error(fmt.Sprintf("can't get snapshot info: %s", err.Error()))
+			return
+		}
+
+		// on SIGINT and SIGTERM the sync is stopped instead of leaving it running in the background
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = snapshots.RestoreSnapshot(ctx, config, snapshotInfo, snapshotConfig, &snapshots.RestoreOptions{})
 		if err != nil {
 			slog.Error("an error occurred while restoring the snapshot: " + err.Error())
 			return
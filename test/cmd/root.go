@@ -4,6 +4,7 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
@@ -49,7 +50,7 @@ var rootCmd = &cobra.Command{
 		}
 
 		snapshotTask := func(snapshotConfig *structs.SnapshotConfig) {
-			snapshotErr := snapshots.ExecuteSnapshot(config, snapshotConfig)
+			snapshotErr := snapshots.ExecuteSnapshot(context.Background(), config, snapshotConfig)
 			if snapshotErr != nil {
 				slog.Error(fmt.Sprintf("[%s] can't execute snapshot: %s", snapshotConfig.SnapshotName, snapshotErr.Error()))
 			}
@@ -3,9 +3,11 @@ package utils
 import (
 	"fmt"
 	"path"
+	"runtime/debug"
 	"snapsync/structs"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func HumanReadableSize(bytes int64) string {
@@ -34,15 +36,155 @@ func GetInfoFromSnapshotBasePath(snapshotPath string) (snapshotName string, numb
 	return snapshotName, number, nil
 }
 
+// SplitSnapshotId splits a snapshot identifier like daily.3, daily.2024-03-12T03-00-00Z or
+// daily.latest into the snapshot name and the selector of the snapshot.
+func SplitSnapshotId(snapshotId string) (snapshotName string, selector string, err error) {
+	snapshotName, selector, found := strings.Cut(snapshotId, ".")
+	if !found || len(snapshotName) == 0 || len(selector) == 0 {
+		return snapshotName, selector, fmt.Errorf("snapshot must be in format <name>.<number>, <name>.<timestamp> or <name>.latest")
+	}
+	return snapshotName, selector, nil
+}
+
+// GetInfoFromSnapshotPath parses the path of a snapshot named <name>.<number> or <name>.<timestamp>.
+// The time of a snapshot with index naming is not part of its name, so it's left empty.
 func GetInfoFromSnapshotPath(snapshotAbspath string) (snapshotInfo *structs.SnapshotInfo, err error) {
 	snapshotDirName := strings.TrimSuffix(path.Base(snapshotAbspath), "/")
 	name, number, err := GetInfoFromSnapshotBasePath(snapshotDirName)
-	if err != nil {
+	if err == nil {
+		return &structs.SnapshotInfo{
+			Abspath:      snapshotAbspath,
+			SnapshotName: name,
+			Number:       number,
+		}, nil
+	}
+	name, timestamp, found := strings.Cut(snapshotDirName, ".")
+	if !found {
 		return nil, err
 	}
+	snapshotTime, timeErr := time.Parse(structs.SnapshotTimeLayout, timestamp)
+	if timeErr != nil {
+		return nil, fmt.Errorf("snapshot name must be in format <name>.<number> or <name>.<timestamp>: %s", snapshotDirName)
+	}
 	return &structs.SnapshotInfo{
 		Abspath:      snapshotAbspath,
 		SnapshotName: name,
-		Number:       number,
+		Number:       -1,
+		Time:         snapshotTime,
+		Timestamped:  true,
 	}, nil
 }
+
+// ParseDuration parses a duration like time.ParseDuration, also accepting days (d), weeks (w) and
+// years (y) of 365 days, e.g. 7d or 1y12h. Fractions and months are not supported.
+func ParseDuration(durationString string) (time.Duration, error) {
+	if duration, err := time.ParseDuration(durationString); err == nil {
+		return duration, nil
+	}
+	units := map[byte]time.Duration{
+		's': time.Second,
+		'm': time.Minute,
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+		'y': 365 * 24 * time.Hour,
+	}
+	var duration time.Duration
+	rest := durationString
+	for len(rest) > 0 {
+		digits := 0
+		for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+			digits++
+		}
+		if digits == 0 || digits == len(rest) {
+			return 0, fmt.Errorf("invalid duration %s", durationString)
+		}
+		value, err := strconv.Atoi(rest[:digits])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", durationString)
+		}
+		unit, ok := units[rest[digits]]
+		if !ok {
+			return 0, fmt.Errorf("invalid unit %c in duration %s", rest[digits], durationString)
+		}
+		duration += time.Duration(value) * unit
+		rest = rest[digits+1:]
+	}
+	if len(durationString) == 0 {
+		return 0, fmt.Errorf("empty duration")
+	}
+	return duration, nil
+}
+
+// SuggestClosest returns the candidate most similar to value, if it's similar enough to be what was
+// meant, to build "did you mean" messages.
+func SuggestClosest(value string, candidates []string) (suggestion string, ok bool) {
+	bestDistance := -1
+	for _, candidate := range candidates {
+		distance := editDistance(strings.ToLower(value), strings.ToLower(candidate))
+		if bestDistance < 0 || distance < bestDistance {
+			bestDistance = distance
+			suggestion = candidate
+		}
+	}
+	// a typo changes a few characters, more than a third of them is another word
+	maxDistance := max(2, len(value)/3)
+	if bestDistance < 0 || bestDistance > maxDistance {
+		return "", false
+	}
+	return suggestion, true
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// GetVersion returns the version of snapsync from the build info: the module version when installed
+// with go install, otherwise the VCS revision it was built from.
+func GetVersion() string {
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := buildInfo.Main.Version
+	if len(version) > 0 && version != "(devel)" {
+		return version
+	}
+	revision := ""
+	modified := false
+	for _, setting := range buildInfo.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if len(revision) == 0 {
+		return "devel"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return "devel-" + revision
+}